@@ -0,0 +1,89 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/loft-sh/log"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/backup"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the instance's volumes to a file or S3",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := options.FromEnv(false)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		location := os.Getenv("BACKUP_LOCATION")
+		if location == "" {
+			return fmt.Errorf("backup location environment variable is missing")
+		}
+
+		h, server, privateKey, err := workspaceServer(ctx, options)
+		if err != nil {
+			return err
+		}
+
+		if err := backup.Save(ctx, location, func(w io.Writer) error {
+			return h.Backup(ctx, server, privateKey, w)
+		}); err != nil {
+			return err
+		}
+
+		log.Default.Infof("Backed up %s to %s", options.MachineID, location)
+
+		return nil
+	},
+}
+
+// workspaceServer returns the workspace's server and the private key used to
+// connect to it
+func workspaceServer(ctx context.Context, opts *options.Options) (*hetzner.Hetzner, *hcloud.Server, []byte, error) {
+	privateKey, err := ssh.GetPrivateKeyRawBase(opts.MachineFolder)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("load private key: %w", err)
+	}
+
+	h := newHetzner(opts)
+	server, err := h.GetByName(ctx, opts.MachineID)
+	if err != nil {
+		return nil, nil, nil, err
+	} else if server == nil {
+		return nil, nil, nil, fmt.Errorf("vm not found")
+	}
+
+	return h, server, privateKey, nil
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+}
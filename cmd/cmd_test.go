@@ -0,0 +1,663 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hcloudtest"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMachineID = "devpod-e2e"
+
+type testEnv struct {
+	api  *hcloudtest.Server
+	sshd *hcloudtest.SSHServer
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	api := hcloudtest.NewServer(t)
+	api.ActionSteps = 1
+	sshd := hcloudtest.NewSSHServer(t)
+
+	t.Setenv("HCLOUD_ENDPOINT", api.Endpoint())
+	t.Setenv("HCLOUD_TOKEN", "test-token")
+	t.Setenv("MACHINE_ID", testMachineID)
+	t.Setenv("MACHINE_FOLDER", t.TempDir())
+	t.Setenv("DISK_IMAGE", "docker-ce")
+	t.Setenv("DISK_SIZE", "30")
+	t.Setenv("MACHINE_TYPE", "cx22")
+	t.Setenv("REGION", "nbg1")
+
+	hetznerOptions = []hetzner.Option{hetzner.WithSSHPort(sshd.Port())}
+	t.Cleanup(func() {
+		hetznerOptions = nil
+	})
+
+	return &testEnv{api: api, sshd: sshd}
+}
+
+func (e *testEnv) run(t *testing.T, args ...string) string {
+	t.Helper()
+
+	stdout, err := e.execute(t, args...)
+	require.NoError(t, err, "command %v", args)
+
+	return stdout
+}
+
+// runErr runs a command which is expected to fail
+func (e *testEnv) runErr(t *testing.T, args ...string) error {
+	t.Helper()
+
+	_, err := e.execute(t, args...)
+	return err
+}
+
+func (e *testEnv) execute(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	stdout := new(bytes.Buffer)
+	rootCmd.SetArgs(args)
+	rootCmd.SetIn(strings.NewReader(""))
+	rootCmd.SetOut(stdout)
+	t.Cleanup(func() {
+		rootCmd.SetArgs(nil)
+		rootCmd.SetIn(nil)
+		rootCmd.SetOut(nil)
+	})
+
+	err := rootCmd.Execute()
+
+	return stdout.String(), err
+}
+
+func (e *testEnv) assertStatus(t *testing.T, status client.Status) {
+	t.Helper()
+
+	assert.Equal(t, string(status), e.run(t, "status"))
+}
+
+// tarball creates a compressed tarball of empty files
+func tarball(t *testing.T, names ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644}))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+func TestLifecycle(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.run(t, "init")
+	e.assertStatus(t, client.StatusNotFound)
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	require.Len(t, e.api.Volumes(), 1)
+	require.Len(t, e.api.SSHKeys(), 1)
+	assert.Equal(t, e.api.Servers()[0].ID, e.api.Volumes()[0].Server.ID)
+	assert.Contains(t, e.api.UserData(testMachineID), "#cloud-config")
+	assert.Contains(t, e.sshd.Commands(), "cloud-init status --long || true")
+
+	t.Setenv("COMMAND", "hostname")
+	assert.Equal(t, "hostname\n", e.run(t, "command"))
+
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusStopped)
+	assert.Empty(t, e.api.Servers())
+	require.Len(t, e.api.Volumes(), 1)
+	assert.Nil(t, e.api.Volumes()[0].Server)
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	assert.Len(t, e.api.Servers(), 1)
+	assert.Len(t, e.api.Volumes(), 1)
+	assert.Len(t, e.api.SSHKeys(), 1)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.Servers())
+	assert.Empty(t, e.api.Volumes())
+	assert.Empty(t, e.api.SSHKeys())
+}
+
+func TestInitInvalidToken(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("HCLOUD_TOKEN", " ")
+
+	assert.Error(t, e.runErr(t, "init"))
+	assert.Empty(t, e.api.Servers())
+}
+
+func TestLifecyclePowerOff(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("STOP_MODE", "poweroff")
+
+	e.run(t, "create")
+	serverID := e.api.Servers()[0].ID
+
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusStopped)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Equal(t, hcloud.ServerStatusOff, e.api.Servers()[0].Status)
+
+	// Starting the kept server grows its volume
+	t.Setenv("DISK_SIZE", "50")
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Equal(t, serverID, e.api.Servers()[0].ID)
+	require.Len(t, e.api.Volumes(), 1)
+	assert.Equal(t, 50, e.api.Volumes()[0].Size)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.Servers())
+	assert.Empty(t, e.api.Volumes())
+	assert.Empty(t, e.api.SSHKeys())
+}
+
+func TestLifecycleSnapshot(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("STOP_MODE", "snapshot")
+
+	snapshots := func() (s []*hcloud.Image) {
+		for _, i := range e.api.Images() {
+			if i.Type == hcloud.ImageTypeSnapshot {
+				s = append(s, i)
+			}
+		}
+		return s
+	}
+
+	e.run(t, "create")
+
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusStopped)
+	assert.Empty(t, e.api.Servers())
+	require.Len(t, snapshots(), 1)
+	snapshot := snapshots()[0]
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Equal(t, snapshot.ID, e.api.Servers()[0].Image.ID)
+	assert.Empty(t, snapshots())
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, snapshots())
+	assert.Empty(t, e.api.Volumes())
+}
+
+func TestLifecycleEphemeral(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PERSISTENT_VOLUME", "false")
+	t.Setenv("STOP_MODE", "snapshot")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Empty(t, e.api.Servers()[0].Volumes)
+	assert.Empty(t, e.api.Volumes())
+	assert.NotContains(t, e.api.UserData(testMachineID), "mounts:")
+
+	// Stopped with a snapshot to start from
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusStopped)
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	assert.Empty(t, e.api.Volumes())
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	for _, i := range e.api.Images() {
+		assert.NotEqual(t, hcloud.ImageTypeSnapshot, i.Type)
+	}
+}
+
+func TestLifecycleEphemeralDelete(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PERSISTENT_VOLUME", "false")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+
+	// Nothing is kept when the server is deleted
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.Servers())
+	assert.Empty(t, e.api.Volumes())
+}
+
+func TestCreateIsIdempotent(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.run(t, "create")
+	serverID := e.api.Servers()[0].ID
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Equal(t, serverID, e.api.Servers()[0].ID)
+	assert.Len(t, e.api.Volumes(), 1)
+}
+
+func TestCreateCloudInitError(t *testing.T) {
+	e := newTestEnv(t)
+	e.sshd.SetHandler(func(command string, _ io.Reader, stdout, _ io.Writer) int {
+		switch {
+		case strings.HasPrefix(command, "cloud-init status"):
+			_, _ = fmt.Fprintln(stdout, "status: error")
+		case strings.Contains(command, "/var/log/cloud-init-output.log"):
+			_, _ = fmt.Fprintln(stdout, "E: Unable to locate package ufw")
+		}
+		return 0
+	})
+
+	err := e.runErr(t, "create")
+	assert.ErrorIs(t, err, hetzner.ErrCloudInitFailed)
+	assert.ErrorContains(t, err, "E: Unable to locate package ufw")
+	assert.Empty(t, e.api.Servers())
+	assert.Empty(t, e.api.Volumes())
+	assert.Empty(t, e.api.SSHKeys())
+}
+
+func TestCreateNetwork(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("NETWORK", "devpod")
+	t.Setenv("NETWORK_IP", "10.0.1.10")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	require.Len(t, e.api.Servers()[0].PrivateNet, 1)
+	assert.Equal(t, "10.0.1.10", e.api.Servers()[0].PrivateNet[0].IP.String())
+}
+
+func TestCreatePrivateThroughJumpHost(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("NETWORK", "devpod")
+	t.Setenv("PUBLIC_IPV4", "false")
+	t.Setenv("PUBLIC_IPV6", "false")
+	t.Setenv("JUMP_HOST", fmt.Sprintf("bastion@127.0.0.1:%d", e.sshd.Port()))
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Nil(t, e.api.Servers()[0].PublicNet.IPv4.IP)
+
+	t.Setenv("COMMAND", "hostname")
+	assert.Equal(t, "hostname\n", e.run(t, "command"))
+
+	// The server's private IP is used, through the jump host
+	assert.Contains(t, e.sshd.Forwards(), fmt.Sprintf("10.0.0.2:%d", e.sshd.Port()))
+}
+
+func TestLifecycleFirewall(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("FIREWALL", "true")
+	t.Setenv("FIREWALL_SSH_SOURCES", "198.51.100.0/24")
+	t.Setenv("FIREWALL_RULES", "tcp:443,icmp")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Firewalls(), 1)
+	firewall := e.api.Firewalls()[0]
+	require.Len(t, firewall.AppliedTo, 1)
+	assert.Equal(t, e.api.Servers()[0].ID, firewall.AppliedTo[0].Server.ID)
+	require.Len(t, firewall.Rules, 3)
+	assert.Equal(t, "198.51.100.0/24", firewall.Rules[0].SourceIPs[0].String())
+
+	// The firewall is kept while the workspace is stopped
+	e.run(t, "stop")
+	e.run(t, "start")
+	assert.Len(t, e.api.Firewalls(), 1)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.Firewalls())
+}
+
+func TestCreateSharedFirewalls(t *testing.T) {
+	e := newTestEnv(t)
+	baseline := e.api.AddFirewall("dev-vm-baseline", map[string]string{"role": "baseline"})
+
+	t.Setenv("FIREWALLS", "unknown")
+	assert.ErrorIs(t, e.runErr(t, "create"), hetzner.ErrUnknownFirewall)
+	assert.Empty(t, e.api.Servers())
+	assert.Empty(t, e.api.SSHKeys())
+
+	// Selectors which aren't an equality, eg one that a label exists, are
+	// never read as a name
+	t.Setenv("FIREWALLS", "")
+	t.Setenv("FIREWALL_SELECTOR", "team")
+	assert.ErrorIs(t, e.runErr(t, "create"), hetzner.ErrUnknownFirewall)
+	assert.Empty(t, e.api.Servers())
+
+	t.Setenv("FIREWALL_SELECTOR", "role")
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Firewalls(), 1)
+	require.Len(t, e.api.Firewalls()[0].AppliedTo, 1)
+	e.run(t, "delete")
+
+	t.Setenv("FIREWALL_SELECTOR", "")
+	t.Setenv("FIREWALLS", "dev-vm-baseline")
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Firewalls(), 1)
+	require.Len(t, e.api.Firewalls()[0].AppliedTo, 1)
+
+	// Shared firewalls are left behind when the workspace is deleted
+	e.run(t, "delete")
+	require.Len(t, e.api.Firewalls(), 1)
+	assert.Equal(t, baseline.ID, e.api.Firewalls()[0].ID)
+	assert.Empty(t, e.api.Firewalls()[0].AppliedTo)
+}
+
+func TestLifecyclePrimaryIPs(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PRIMARY_IPS", "true")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.PrimaryIPs(), 2)
+	serverID := e.api.Servers()[0].ID
+	for _, ip := range e.api.PrimaryIPs() {
+		assert.Equal(t, serverID, ip.AssigneeID)
+		assert.Equal(t, testMachineID, ip.Labels["machineId"])
+	}
+
+	// The primary IPs are kept while the server is deleted and reassigned on start
+	e.run(t, "stop")
+	require.Len(t, e.api.PrimaryIPs(), 2)
+	assert.Zero(t, e.api.PrimaryIPs()[0].AssigneeID)
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.PrimaryIPs(), 2)
+	assert.Equal(t, e.api.Servers()[0].ID, e.api.PrimaryIPs()[0].AssigneeID)
+	assert.Equal(t, e.api.PrimaryIPs()[0].ID, e.api.Servers()[0].PublicNet.IPv4.ID)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.PrimaryIPs())
+}
+
+func TestLifecyclePlacementGroup(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PLACEMENT_GROUP", "devpod-spread")
+
+	e.run(t, "create")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.PlacementGroups(), 1)
+	assert.Equal(t, hcloud.PlacementGroupTypeSpread, e.api.PlacementGroups()[0].Type)
+	assert.Equal(t, []int64{e.api.Servers()[0].ID}, e.api.PlacementGroups()[0].Servers)
+
+	// The group is left in place while the workspace is stopped
+	e.run(t, "stop")
+	e.run(t, "start")
+	require.Len(t, e.api.PlacementGroups(), 1)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.PlacementGroups())
+}
+
+func TestCreateLabels(t *testing.T) {
+	e := newTestEnv(t)
+
+	t.Setenv("LABELS", "team=payments,cost centre=42")
+	assert.ErrorContains(t, e.runErr(t, "create"), "cost centre")
+	assert.Empty(t, e.api.SSHKeys())
+
+	t.Setenv("LABELS", "team=payments,project=checkout")
+	e.run(t, "create")
+	require.Len(t, e.api.Servers(), 1)
+	assert.Equal(t, "payments", e.api.Servers()[0].Labels["team"])
+	assert.Equal(t, "checkout", e.api.Volumes()[0].Labels["project"])
+	assert.Equal(t, "payments", e.api.SSHKeys()[0].Labels["team"])
+}
+
+func TestCreateCloudInitExtra(t *testing.T) {
+	e := newTestEnv(t)
+
+	extra := filepath.Join(t.TempDir(), "extra.yaml")
+	require.NoError(t, os.WriteFile(extra, []byte("packages:\n  - htop\nruncmd:\n  - echo {{ .Options.MachineType }}\n"), 0o600))
+	t.Setenv("CLOUD_INIT_EXTRA", extra)
+
+	e.run(t, "create")
+	userData := e.api.UserData(testMachineID)
+	assert.True(t, strings.HasPrefix(userData, "#cloud-config\n"))
+	assert.Contains(t, userData, "- htop")
+	assert.Contains(t, userData, "- echo cx22")
+	assert.Contains(t, userData, "- ufw")
+}
+
+func TestLifecycleResizeVolume(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.run(t, "create")
+	e.run(t, "stop")
+
+	t.Setenv("DISK_SIZE", "50")
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	require.Len(t, e.api.Volumes(), 1)
+	assert.Equal(t, 50, e.api.Volumes()[0].Size)
+
+	e.run(t, "stop")
+
+	t.Setenv("DISK_SIZE", "40")
+	assert.ErrorContains(t, e.runErr(t, "start"), "can't be shrunk")
+	assert.Equal(t, 50, e.api.Volumes()[0].Size)
+	assert.Empty(t, e.api.Servers())
+}
+
+func TestCreateInvalidDiskSize(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PRIMARY_IPS", "true")
+	t.Setenv("FIREWALL", "true")
+
+	for _, size := range []string{"30GB", "5"} {
+		t.Setenv("DISK_SIZE", size)
+		assert.ErrorContains(t, e.runErr(t, "create"), `invalid DISK_SIZE "`+size+`"`)
+	}
+
+	// Nothing billed is created before the options are checked
+	assert.Empty(t, e.api.SSHKeys())
+	assert.Empty(t, e.api.PrimaryIPs())
+	assert.Empty(t, e.api.Firewalls())
+	assert.Empty(t, e.api.Volumes())
+	assert.Empty(t, e.api.Servers())
+}
+
+func TestCreateVolumeMount(t *testing.T) {
+	e := newTestEnv(t)
+
+	t.Setenv("VOLUME_FILESYSTEM", "btrfs")
+	assert.ErrorContains(t, e.runErr(t, "create"), `unknown VOLUME_FILESYSTEM "btrfs"`)
+	assert.Empty(t, e.api.Volumes())
+
+	t.Setenv("VOLUME_FILESYSTEM", "xfs")
+	t.Setenv("VOLUME_MOUNT_PATH", "/workspaces/")
+	t.Setenv("VOLUME_MOUNT_OPTIONS", "noatime,nofail")
+
+	e.run(t, "create")
+	require.Len(t, e.api.Volumes(), 1)
+	assert.Equal(t, hcloud.Ptr("xfs"), e.api.Volumes()[0].Format)
+
+	userData := e.api.UserData(testMachineID)
+	assert.Contains(t, userData, `- "/workspaces"`)
+	assert.Contains(t, userData, `- "noatime,nofail"`)
+}
+
+func TestLifecycleExtraVolumes(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("PERSISTENT_VOLUME", "false")
+	t.Setenv("EXTRA_VOLUMES", "docker:50:/var/lib/docker,cache:20:/srv/cache")
+
+	e.run(t, "create")
+	require.Len(t, e.api.Volumes(), 2)
+	require.Len(t, e.api.Servers(), 1)
+	assert.Len(t, e.api.Servers()[0].Volumes, 2)
+
+	userData := e.api.UserData(testMachineID)
+	assert.Contains(t, userData, `- "/var/lib/docker"`)
+	assert.Contains(t, userData, `- "/srv/cache"`)
+
+	// The extra volumes are kept, so it can be started again
+	e.run(t, "stop")
+	e.assertStatus(t, client.StatusStopped)
+	assert.Len(t, e.api.Volumes(), 2)
+
+	e.run(t, "start")
+	e.assertStatus(t, client.StatusRunning)
+	assert.Len(t, e.api.Volumes(), 2)
+
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+	assert.Empty(t, e.api.Volumes())
+}
+
+func TestCreateExtraVolumesInvalid(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("EXTRA_VOLUMES", "docker:5:/var/lib/docker")
+
+	assert.ErrorContains(t, e.runErr(t, "create"), "invalid EXTRA_VOLUMES: volume docker size \"5\" must be a number of GB, at least 10")
+	assert.Empty(t, e.api.Volumes())
+}
+
+func TestCreateContainerRuntime(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("DISK_IMAGE", "debian-12")
+
+	e.run(t, "create")
+	userData := e.api.UserData(testMachineID)
+	assert.Contains(t, userData, "- docker.io")
+	assert.NotContains(t, userData, "get.docker.com")
+}
+
+func TestCreateUserDataParts(t *testing.T) {
+	e := newTestEnv(t)
+
+	script := filepath.Join(t.TempDir(), "bootstrap.sh")
+	require.NoError(t, os.WriteFile(script, []byte("echo no shebang\n"), 0o600))
+	t.Setenv("USER_DATA_SCRIPTS", script)
+
+	assert.ErrorContains(t, e.runErr(t, "create"), "must start with a shebang")
+	assert.Empty(t, e.api.Servers())
+
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/bash\necho bootstrap\n"), 0o600))
+	t.Setenv("USER_DATA_INCLUDES", "https://example.com/bootstrap.yaml")
+
+	e.run(t, "create")
+	userData := e.api.UserData(testMachineID)
+	assert.True(t, strings.HasPrefix(userData, "Content-Type: multipart/mixed; boundary="))
+	assert.Contains(t, userData, "Content-Type: text/cloud-config")
+	assert.Contains(t, userData, "Content-Type: text/x-shellscript")
+	assert.Contains(t, userData, "#!/bin/bash\necho bootstrap\n")
+	assert.Contains(t, userData, "#include\nhttps://example.com/bootstrap.yaml\n")
+
+	// The scripts are only needed to create the server
+	require.NoError(t, os.Remove(script))
+	e.assertStatus(t, client.StatusRunning)
+	e.run(t, "delete")
+	e.assertStatus(t, client.StatusNotFound)
+}
+
+func TestBackupRestore(t *testing.T) {
+	e := newTestEnv(t)
+	t.Setenv("VOLUME_MOUNT_PATH", "/workspaces")
+	t.Setenv("EXTRA_VOLUMES", "docker:50:/var/lib/docker")
+	location := filepath.Join(t.TempDir(), "backup.tar.gz")
+	t.Setenv("BACKUP_LOCATION", location)
+
+	e.run(t, "create")
+
+	archive := tarball(t, "./workspaces/README.md", "./var/lib/docker/volumes/data")
+	var restored []byte
+	e.sshd.SetHandler(func(command string, stdin io.Reader, stdout, _ io.Writer) int {
+		switch command {
+		case "sudo -n tar -C / -czf - './workspaces' './var/lib/docker' || [ $? -eq 1 ]":
+			_, _ = stdout.Write(archive)
+		case "sudo -n tar -C / --same-owner -xzpf - './workspaces' './var/lib/docker'":
+			restored, _ = io.ReadAll(stdin)
+		default:
+			return 1
+		}
+		return 0
+	})
+
+	e.run(t, "backup")
+	data, err := os.ReadFile(location)
+	require.NoError(t, err)
+	assert.Equal(t, archive, data)
+
+	e.run(t, "restore")
+	assert.Equal(t, archive, restored)
+
+	// A backup with files outside the volumes isn't restored
+	require.NoError(t, os.WriteFile(location, tarball(t, "./workspaces/README.md", "./etc/passwd"), 0o600))
+	err = e.runErr(t, "restore")
+	assert.ErrorIs(t, err, hetzner.ErrInvalidBackup)
+	assert.ErrorContains(t, err, "./etc/passwd is outside the workspace's volumes")
+	require.NoError(t, os.WriteFile(location, archive, 0o600))
+
+	// The backup is kept if the next one fails
+	e.sshd.SetHandler(func(_ string, _ io.Reader, _, stderr io.Writer) int {
+		_, _ = io.WriteString(stderr, "tar: Cannot open: Permission denied")
+		return 2
+	})
+
+	assert.ErrorContains(t, e.runErr(t, "backup"), "tar: Cannot open: Permission denied")
+	data, err = os.ReadFile(location)
+	require.NoError(t, err)
+	assert.Equal(t, archive, data)
+
+	// There's nothing to back up without any volumes
+	t.Setenv("PERSISTENT_VOLUME", "false")
+	t.Setenv("EXTRA_VOLUMES", "")
+	assert.ErrorIs(t, e.runErr(t, "backup"), hetzner.ErrNoVolumes)
+}
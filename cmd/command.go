@@ -22,7 +22,6 @@ import (
 	"os"
 
 	"github.com/loft-sh/devpod/pkg/ssh"
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -52,15 +51,16 @@ var commandCmd = &cobra.Command{
 		}
 
 		// Create SSH client
-		server, err := hetzner.NewHetzner(options.Token).GetByName(ctx, options.MachineID)
+		h := newHetzner(options)
+		server, err := h.GetByName(ctx, options.MachineID)
 		if err != nil {
 			return err
 		} else if server == nil {
 			return fmt.Errorf("vm not found")
 		}
 
-		// Call external address
-		sshClient, err := ssh.NewSSHClient(hetzner.SSHUsername, fmt.Sprintf("%s:%d", server.PublicNet.IPv4.IP, hetzner.SSHPort), privateKey)
+		// Connect directly or through the jump host
+		sshClient, err := h.SSHClient(server, privateKey)
 		if err != nil {
 			return errors.Wrap(err, "create ssh client")
 		}
@@ -69,7 +69,7 @@ var commandCmd = &cobra.Command{
 		}()
 
 		// Run command
-		if err := ssh.Run(ctx, sshClient, command, os.Stdin, os.Stdout, os.Stderr, nil); err != nil {
+		if err := ssh.Run(ctx, sshClient, command, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr(), nil); err != nil {
 			return err
 		}
 
@@ -18,9 +18,8 @@ package cmd
 
 import (
 	"context"
-	"strconv"
 
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
+	"github.com/loft-sh/devpod/pkg/ssh"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -40,22 +39,24 @@ func createOrStartServer(cmd *cobra.Command, args []string) error {
 	}
 
 	ctx := context.Background()
-	h := hetzner.NewHetzner(opts.Token)
+	h := newHetzner(opts)
 
-	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	// Power on a server kept by a previous stop
+	privateKey, err := ssh.GetPrivateKeyRawBase(opts.MachineFolder)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "load private key")
 	}
-	if publicKey == nil {
-		return errors.New("no public key generated")
+
+	if started, err := h.Start(ctx, opts.MachineID, opts.DiskSize, privateKey); err != nil || started {
+		return err
 	}
 
-	diskSize, err := strconv.Atoi(opts.DiskSize)
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
 	if err != nil {
-		return errors.Wrap(err, "parse disk size")
+		return err
 	}
 
-	return h.Create(ctx, req, diskSize, *publicKey, privateKey)
+	return h.Create(ctx, req, opts.DiskSize, *publicKey, privateKey)
 }
 
 func init() {
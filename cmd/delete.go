@@ -22,7 +22,6 @@ import (
 
 	"github.com/loft-sh/devpod/pkg/client"
 	"github.com/loft-sh/log"
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/spf13/cobra"
 )
@@ -38,7 +37,7 @@ var deleteCmd = &cobra.Command{
 		}
 
 		ctx := context.Background()
-		hetznerClient := hetzner.NewHetzner(options.Token)
+		hetznerClient := newHetzner(options)
 
 		err = hetznerClient.Delete(ctx, options.MachineID)
 		if err != nil {
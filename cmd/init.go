@@ -19,7 +19,6 @@ package cmd
 import (
 	"context"
 
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/spf13/cobra"
 )
@@ -34,7 +33,7 @@ var initCmd = &cobra.Command{
 			return err
 		}
 
-		return hetzner.NewHetzner(options.Token).Init(context.Background())
+		return newHetzner(options).Init(context.Background())
 	},
 }
 
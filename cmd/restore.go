@@ -0,0 +1,72 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/loft-sh/log"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/backup"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the instance's volumes from a backup",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := options.FromEnv(false)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+
+		location := os.Getenv("BACKUP_LOCATION")
+		if location == "" {
+			return fmt.Errorf("backup location environment variable is missing")
+		}
+
+		h, server, privateKey, err := workspaceServer(ctx, options)
+		if err != nil {
+			return err
+		}
+
+		r, err := backup.Open(ctx, location)
+		if err != nil {
+			return fmt.Errorf("open backup: %w", err)
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+
+		if err := h.Restore(ctx, server, privateKey, r); err != nil {
+			return err
+		}
+
+		log.Default.Infof("Restored %s from %s", options.MachineID, location)
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -20,11 +20,16 @@ import (
 	"os"
 
 	"github.com/loft-sh/log"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// hetznerOptions are applied to every Hetzner client - used to inject test dependencies
+var hetznerOptions []hetzner.Option
+
 var rootCmd = &cobra.Command{
 	Use:     "devpod-provider-hetzner",
 	Short:   "DevPod on Hetzner",
@@ -55,3 +60,27 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+func newHetzner(opts *options.Options) *hetzner.Hetzner {
+	return hetzner.NewHetzner(opts.Token, append([]hetzner.Option{
+		hetzner.WithAddressPreference(opts.AddressPreference),
+		hetzner.WithCloudInit(opts.CloudInitExtra, opts),
+		hetzner.WithCloudConfigUnknownKeys(opts.CloudInitAllowUnknownKeys),
+		hetzner.WithContainerRuntime(opts.ContainerRuntime),
+		hetzner.WithEndpoint(opts.Endpoint),
+		hetzner.WithExtraVolumes(opts.ExtraVolumes),
+		hetzner.WithFirewall(opts.Firewall, opts.FirewallSSH, opts.FirewallRules),
+		hetzner.WithJumpHost(opts.JumpHostUser, opts.JumpHostAddress, opts.JumpHostKey),
+		hetzner.WithLabels(opts.Labels),
+		hetzner.WithNetwork(opts.Network, opts.NetworkIP),
+		hetzner.WithPersistentVolume(opts.PersistentVolume),
+		hetzner.WithPlacementGroup(opts.PlacementGroup),
+		hetzner.WithPrimaryIPs(opts.PrimaryIPs),
+		hetzner.WithPublicNet(opts.PublicIPv4, opts.PublicIPv6),
+		hetzner.WithProvisionTimeout(opts.ProvisionTimeout),
+		hetzner.WithRollback(opts.Rollback),
+		hetzner.WithSharedFirewalls(opts.Firewalls, opts.FirewallSelector),
+		hetzner.WithUserDataParts(opts.UserDataScripts, opts.UserDataIncludes),
+		hetzner.WithVolume(opts.VolumeFilesystem, opts.VolumeMountPath, opts.VolumeMountOptions),
+	}, hetznerOptions...)...)
+}
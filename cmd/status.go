@@ -19,9 +19,7 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"os"
 
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/spf13/cobra"
 )
@@ -30,18 +28,18 @@ import (
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Retrieve the status of an instance",
-	RunE: func(_ *cobra.Command, args []string) error {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		options, err := options.FromEnv(false)
 		if err != nil {
 			return err
 		}
 
-		status, err := hetzner.NewHetzner(options.Token).Status(context.Background(), options.MachineID)
+		status, err := newHetzner(options).Status(context.Background(), options.MachineID)
 		if err != nil {
 			return err
 		}
 
-		_, err = fmt.Fprint(os.Stdout, status)
+		_, err = fmt.Fprint(cmd.OutOrStdout(), status)
 		return err
 	},
 }
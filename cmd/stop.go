@@ -22,7 +22,6 @@ import (
 
 	"github.com/loft-sh/devpod/pkg/client"
 	"github.com/loft-sh/log"
-	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/hetzner"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/spf13/cobra"
 )
@@ -39,20 +38,21 @@ var stopCmd = &cobra.Command{
 
 		ctx := context.Background()
 
-		hetznerClient := hetzner.NewHetzner(options.Token)
+		hetznerClient := newHetzner(options)
 
-		err = hetznerClient.Stop(ctx, options.MachineID)
+		err = hetznerClient.Stop(ctx, options.MachineID, options.StopMode)
 		if err != nil {
 			return err
 		}
 
-		// Wait until it's stopped
+		// Wait until it's stopped. A deleted server with nothing kept to start
+		// it again from, such as an ephemeral workspace, is gone completely.
 		for {
 			status, err := hetznerClient.Status(ctx, options.MachineID)
 			if err != nil {
 				log.Default.Errorf("Error retrieving server status: %v", err)
 				break
-			} else if status == client.StatusStopped {
+			} else if status == client.StatusStopped || status == client.StatusNotFound {
 				break
 			}
 
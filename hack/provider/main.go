@@ -134,8 +134,48 @@ func BuildConfig(
 				DefaultVisible: true,
 				Options: []string{
 					"DISK_SIZE",
+					"PERSISTENT_VOLUME",
+					"VOLUME_FILESYSTEM",
+					"VOLUME_MOUNT_PATH",
+					"VOLUME_MOUNT_OPTIONS",
+					"EXTRA_VOLUMES",
 					"DISK_IMAGE",
+					"CONTAINER_RUNTIME",
 					"MACHINE_TYPE",
+					"STOP_MODE",
+					"PLACEMENT_GROUP",
+					"LABELS",
+					"ROLLBACK_ON_FAILURE",
+					"PROVISION_TIMEOUT",
+					"CLOUD_INIT_EXTRA",
+					"CLOUD_INIT_ALLOW_UNKNOWN_KEYS",
+					"USER_DATA_SCRIPTS",
+					"USER_DATA_INCLUDES",
+				},
+			},
+			{
+				Name:           "Network options",
+				DefaultVisible: false,
+				Options: []string{
+					"NETWORK",
+					"NETWORK_IP",
+					"ADDRESS_PREFERENCE",
+					"PUBLIC_IPV4",
+					"PUBLIC_IPV6",
+					"PRIMARY_IPS",
+					"JUMP_HOST",
+					"JUMP_HOST_KEY",
+				},
+			},
+			{
+				Name:           "Firewall options",
+				DefaultVisible: false,
+				Options: []string{
+					"FIREWALL",
+					"FIREWALL_SSH_SOURCES",
+					"FIREWALL_RULES",
+					"FIREWALLS",
+					"FIREWALL_SELECTOR",
 				},
 			},
 			{
@@ -169,21 +209,164 @@ fi`,
 				Local:       true,
 			},
 			"DISK_SIZE": {
-				Description: "The disk size in GB.",
+				Description: "The disk size in GB, at least 10. Increasing it grows the volume on the next start. It can't be decreased.",
 				Default:     "30",
 				Local:       true,
 			},
+			"PERSISTENT_VOLUME": {
+				Description: "Keep the workspace's data on a volume. Without one, stopping with STOP_MODE=delete discards the workspace.",
+				Default:     "true",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"VOLUME_FILESYSTEM": {
+				Description: "The filesystem the volume is formatted with. It can't be changed once the volume exists.",
+				Default:     "ext4",
+				Enum: types.OptionEnumArray{
+					{Value: "ext4", DisplayName: "ext4"},
+					{Value: "xfs", DisplayName: "XFS"},
+				},
+				Local: true,
+			},
+			"VOLUME_MOUNT_PATH": {
+				Description: "Where the volume is mounted, eg /workspaces. Defaults to the user's home directory.",
+				Local:       true,
+			},
+			"VOLUME_MOUNT_OPTIONS": {
+				Description: "Comma separated options the volume is mounted with.",
+				Default:     "discard,nofail,defaults",
+				Local:       true,
+			},
+			"EXTRA_VOLUMES": {
+				Description: "Comma separated extra volumes as name:size:path, eg docker:50:/var/lib/docker. They're kept when the workspace stops.",
+				Local:       true,
+			},
 			"DISK_IMAGE": {
 				Description: "The disk image to use.",
 				Default:     "docker-ce",
 				Local:       true,
 			},
+			"CONTAINER_RUNTIME": {
+				Description: "How to install the container runtime: skip, get-docker, distro-package or podman. Chosen from the disk image if empty.",
+				Local:       true,
+			},
 			"MACHINE_TYPE": {
 				Description: "The machine type to use.",
 				Default:     defaultMachineType,
 				Enum:        machineTypes,
 				Local:       true,
 			},
+			"STOP_MODE": {
+				Description: "What happens to the server when the workspace stops. Power off and shut down keep it; a snapshot is deleted on restore.",
+				Default:     "delete",
+				Enum: types.OptionEnumArray{
+					{Value: "delete", DisplayName: "Delete"},
+					{Value: "poweroff", DisplayName: "Power off"},
+					{Value: "shutdown", DisplayName: "Shut down"},
+					{Value: "snapshot", DisplayName: "Snapshot and delete"},
+				},
+				Local: true,
+			},
+			"PLACEMENT_GROUP": {
+				Description: "Spread placement group to put the server in, so workspaces run on different hosts. Created if it doesn't exist.",
+				Local:       true,
+			},
+			"LABELS": {
+				Description: "Comma separated labels to add to every resource created. E.g. team=payments,project=checkout",
+				Local:       true,
+			},
+			"ROLLBACK_ON_FAILURE": {
+				Description: "Remove the resources created by a failed workspace creation.",
+				Default:     "true",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"PROVISION_TIMEOUT": {
+				Description: "How long to wait for a new server to finish provisioning. E.g. 10m",
+				Default:     "10m",
+				Type:        "duration",
+				Local:       true,
+			},
+			"CLOUD_INIT_EXTRA": {
+				Description: "Path to a file, or inline YAML, merged into the server's cloud-config. Provider options are available as {{ .Options }}.",
+				Local:       true,
+			},
+			"CLOUD_INIT_ALLOW_UNKNOWN_KEYS": {
+				Description: "Allow keys in CLOUD_INIT_EXTRA the provider doesn't know, eg from a newer cloud-init, instead of rejecting them.",
+				Default:     "false",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"USER_DATA_SCRIPTS": {
+				Description: "Comma separated paths to shell scripts run on the server's first boot, eg ~/devpod/bootstrap.sh",
+				Local:       true,
+			},
+			"USER_DATA_INCLUDES": {
+				Description: "Comma separated URLs of cloud-config or scripts for cloud-init to download and run on first boot",
+				Local:       true,
+			},
+			"NETWORK": {
+				Description: "The name or ID of an existing private network to join.",
+				Local:       true,
+			},
+			"NETWORK_IP": {
+				Description: "The IP to use in the private network. If empty, one is assigned automatically.",
+				Local:       true,
+			},
+			"ADDRESS_PREFERENCE": {
+				Description: "Comma separated order of the addresses to connect to: ipv4, ipv6 and private.",
+				Default:     "ipv4,ipv6,private",
+				Local:       true,
+			},
+			"PUBLIC_IPV4": {
+				Description: "Give the server a public IPv4 address.",
+				Default:     "true",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"PUBLIC_IPV6": {
+				Description: "Give the server a public IPv6 address.",
+				Default:     "true",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"PRIMARY_IPS": {
+				Description: "Keep the server's public IPs across stop and start. They are released when the workspace is deleted.",
+				Default:     "false",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"JUMP_HOST": {
+				Description: "Connect to the server through this SSH jump host. E.g. root@bastion.example.com:22",
+				Local:       true,
+			},
+			"JUMP_HOST_KEY": {
+				Description: "Path to the private key for the jump host. Defaults to the workspace key.",
+				Local:       true,
+			},
+			"FIREWALL": {
+				Description: "Create a firewall for the workspace, only allowing SSH and the extra rules.",
+				Default:     "false",
+				Type:        "boolean",
+				Local:       true,
+			},
+			"FIREWALL_SSH_SOURCES": {
+				Description: "Comma separated IPs or CIDRs allowed to connect with SSH.",
+				Default:     "0.0.0.0/0,::/0",
+				Local:       true,
+			},
+			"FIREWALL_RULES": {
+				Description: "Extra inbound rules as protocol:port:source|source, comma separated. E.g. tcp:443,icmp",
+				Local:       true,
+			},
+			"FIREWALL_SELECTOR": {
+				Description: "Apply the existing firewalls matching a label selector. E.g. role=baseline",
+				Local:       true,
+			},
+			"FIREWALLS": {
+				Description: "Existing firewalls to apply, as comma separated names. E.g. dev-vm-baseline",
+				Local:       true,
+			},
 			"INACTIVITY_TIMEOUT": {
 				Description: "If defined, will automatically stop the VM after the inactivity period.",
 				Default:     "10m",
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package backup stores workspace backups in a local file or in S3
+// compatible object storage
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const s3Scheme = "s3://"
+
+var (
+	ErrInvalidLocation = errors.New("invalid backup location")
+	ErrS3Credentials   = errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for S3 backups")
+)
+
+// WriteFunc writes the backup to w
+type WriteFunc func(w io.Writer) error
+
+// Save stores the backup written by write at location, which is a local file
+// path or an s3://bucket/key URL. If write fails, nothing is left at
+// location, so an earlier backup there isn't replaced by a partial one.
+func Save(ctx context.Context, location string, write WriteFunc) error {
+	bucket, key, isS3, err := parseLocation(location)
+	if err != nil {
+		return err
+	}
+
+	if !isS3 {
+		return saveFile(location, write)
+	}
+
+	client, err := s3FromEnv()
+	if err != nil {
+		return err
+	}
+
+	// The backup is streamed as a multipart upload, which is aborted if the
+	// backup fails
+	r, w := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := write(w)
+		_ = w.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	_, err = client.PutObject(ctx, bucket, key, r, -1, minio.PutObjectOptions{
+		ContentType: "application/gzip",
+	})
+	_ = r.CloseWithError(err)
+
+	// A failed backup also fails the upload
+	if werr := <-writeErr; werr != nil && (err == nil || errors.Is(err, werr)) {
+		return werr
+	}
+	if err != nil {
+		return fmt.Errorf("upload backup: %w", err)
+	}
+
+	return nil
+}
+
+// Open reads the backup at location, which is a local file path or an
+// s3://bucket/key URL
+func Open(ctx context.Context, location string) (io.ReadCloser, error) {
+	bucket, key, isS3, err := parseLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isS3 {
+		return os.Open(location)
+	}
+
+	client, err := s3FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects are only requested when they're first read or checked
+	if _, err := object.Stat(); err != nil {
+		_ = object.Close()
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// s3FromEnv connects to AWS S3, or the S3 compatible BACKUP_S3_ENDPOINT,
+// with the standard AWS environment variables
+func s3FromEnv() (*minio.Client, error) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return nil, ErrS3Credentials
+	}
+
+	endpoint := os.Getenv("BACKUP_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: BACKUP_S3_ENDPOINT %q must be an http or https URL", ErrInvalidLocation, endpoint)
+	}
+
+	return minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: u.Scheme == "https",
+		Region: os.Getenv("AWS_REGION"),
+	})
+}
+
+// parseLocation splits an s3://bucket/key URL. Anything else is a local path.
+func parseLocation(location string) (bucket, key string, isS3 bool, err error) {
+	if location == "" {
+		return "", "", false, fmt.Errorf("%w: location is empty", ErrInvalidLocation)
+	}
+
+	rest, isS3 := strings.CutPrefix(location, s3Scheme)
+	if !isS3 {
+		return "", "", false, nil
+	}
+
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", false, fmt.Errorf("%w: %s must be s3://bucket/key", ErrInvalidLocation, location)
+	}
+
+	return bucket, key, true, nil
+}
+
+// saveFile writes to a temporary file next to path, renaming it into place
+// once the backup is complete
+func saveFile(path string, write WriteFunc) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("create backup file: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write backup file: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Location string
+		Bucket   string
+		Key      string
+		IsS3     bool
+		Error    bool
+	}{
+		{Name: "file", Location: "/tmp/backup.tar.gz"},
+		{Name: "relative file", Location: "backup.tar.gz"},
+		{Name: "s3", Location: "s3://backups/devpod/workspace.tar.gz", Bucket: "backups", Key: "devpod/workspace.tar.gz", IsS3: true},
+		{Name: "empty", Location: "", Error: true},
+		{Name: "no key", Location: "s3://backups", Error: true},
+		{Name: "prefix only", Location: "s3://backups/devpod/", Error: true},
+		{Name: "no bucket", Location: "s3:///workspace.tar.gz", Error: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			bucket, key, isS3, err := parseLocation(test.Location)
+			if test.Error {
+				assert.ErrorIs(t, err, ErrInvalidLocation)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Bucket, bucket)
+			assert.Equal(t, test.Key, key)
+			assert.Equal(t, test.IsS3, isS3)
+		})
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	ctx := context.Background()
+	location := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+	err := Save(ctx, location, func(w io.Writer) error {
+		_, err := io.WriteString(w, "first")
+		return err
+	})
+	assert.NoError(t, err)
+
+	// A failed backup leaves the previous one in place
+	err = Save(ctx, location, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return errors.New("connection lost")
+	})
+	assert.EqualError(t, err, "connection lost")
+
+	r, err := Open(ctx, location)
+	if assert.NoError(t, err) {
+		defer func() {
+			_ = r.Close()
+		}()
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(data))
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(location))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// fakeS3 implements enough of the S3 API to upload objects with multipart
+// uploads and download them again
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("BACKUP_S3_ENDPOINT", srv.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	return f
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := r.URL.Query()
+	key := r.URL.Path
+	uploadID := q.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		uploadID = fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[uploadID] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		part, _ := strconv.Atoi(q.Get("partNumber"))
+		body, err := readChunked(r)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		f.uploads[uploadID][part] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, part))
+	case r.Method == http.MethodPost && uploadID != "":
+		parts := f.uploads[uploadID]
+		var object []byte
+		for i := 1; i <= len(parts); i++ {
+			object = append(object, parts[i]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(key, "/"), "/")
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string   `xml:"Bucket"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Bucket: bucket, Key: name, ETag: `"object"`})
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		http.ServeContent(w, r, key, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(object))
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+// readChunked decodes a body sent with the aws-chunked encoding, which signs
+// each chunk of a streamed upload
+func readChunked(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var body []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body, nil
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func TestSaveOpenS3(t *testing.T) {
+	s3 := newFakeS3(t)
+
+	ctx := context.Background()
+	location := "s3://backups/devpod/my workspace.tar.gz"
+
+	err := Save(ctx, location, func(w io.Writer) error {
+		_, err := io.WriteString(w, "archive")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(s3.objects["/backups/devpod/my workspace.tar.gz"]))
+
+	r, err := Open(ctx, location)
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "archive", string(data))
+		_ = r.Close()
+	}
+
+	// A failed backup aborts the upload, keeping the previous backup
+	err = Save(ctx, location, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return errors.New("connection lost")
+	})
+	assert.EqualError(t, err, "connection lost")
+	assert.Equal(t, "archive", string(s3.objects["/backups/devpod/my workspace.tar.gz"]))
+	assert.Empty(t, s3.uploads)
+
+	_, err = Open(ctx, "s3://backups/missing.tar.gz")
+	assert.ErrorContains(t, err, "The specified key does not exist.")
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	_, err = Open(ctx, location)
+	assert.ErrorIs(t, err, ErrS3Credentials)
+}
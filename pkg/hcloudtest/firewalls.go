@@ -0,0 +1,200 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// Firewalls returns the firewalls that currently exist
+func (s *Server) Firewalls() []*hcloud.Firewall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.Firewall{}, s.firewalls...)
+}
+
+// AddFirewall adds an existing firewall, such as one shared between workspaces
+func (s *Server) AddFirewall(name string, labels map[string]string) *hcloud.Firewall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	firewall := &hcloud.Firewall{ID: s.id(), Name: name, Labels: labels}
+	s.firewalls = append(s.firewalls, firewall)
+
+	return firewall
+}
+
+func (s *Server) firewallByID(id int64) *hcloud.Firewall {
+	for _, firewall := range s.firewalls {
+		if firewall.ID == id {
+			return firewall
+		}
+	}
+	return nil
+}
+
+// applyFirewall applies the firewall to the server, as happens when a server
+// is created with it
+func applyFirewall(firewall *hcloud.Firewall, server *hcloud.Server) {
+	firewall.AppliedTo = append(firewall.AppliedTo, hcloud.FirewallResource{
+		Type:   hcloud.FirewallResourceTypeServer,
+		Server: &hcloud.FirewallResourceServer{ID: server.ID},
+	})
+}
+
+// removeFirewalls removes the server from all firewalls, as happens when it
+// is deleted
+func (s *Server) removeFirewalls(server *hcloud.Server) {
+	for _, firewall := range s.firewalls {
+		firewall.AppliedTo = slices.DeleteFunc(firewall.AppliedTo, func(r hcloud.FirewallResource) bool {
+			return r.Server != nil && r.Server.ID == server.ID
+		})
+	}
+}
+
+func firewallRulesFromRequest(req []schema.FirewallRuleRequest) ([]hcloud.FirewallRule, error) {
+	rules := make([]hcloud.FirewallRule, 0, len(req))
+	for _, r := range req {
+		rule := hcloud.FirewallRule{
+			Direction:   hcloud.FirewallRuleDirection(r.Direction),
+			Protocol:    hcloud.FirewallRuleProtocol(r.Protocol),
+			Port:        r.Port,
+			Description: r.Description,
+		}
+		for _, source := range r.SourceIPs {
+			_, ipNet, err := net.ParseCIDR(source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source ip %q", source)
+			}
+			rule.SourceIPs = append(rule.SourceIPs, *ipNet)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *Server) listFirewalls(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	firewalls := make([]schema.Firewall, 0)
+	for _, firewall := range s.firewalls {
+		if q.Has("name") && firewall.Name != q.Get("name") {
+			continue
+		}
+		if !matchesLabels(firewall.Labels, q.Get("label_selector")) {
+			continue
+		}
+		firewalls = append(firewalls, hcloud.SchemaFromFirewall(firewall))
+	}
+
+	writeList(w, "firewalls", firewalls, len(firewalls))
+}
+
+func (s *Server) createFirewall(w http.ResponseWriter, r *http.Request) {
+	var req schema.FirewallCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	if slices.ContainsFunc(s.firewalls, func(f *hcloud.Firewall) bool { return f.Name == req.Name }) {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "firewall name is already used")
+		return
+	}
+
+	rules, err := firewallRulesFromRequest(req.Rules)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput, err.Error())
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	firewall := &hcloud.Firewall{
+		ID:     s.id(),
+		Name:   req.Name,
+		Labels: labels,
+		Rules:  rules,
+	}
+	s.firewalls = append(s.firewalls, firewall)
+
+	writeJSON(w, http.StatusCreated, schema.FirewallCreateResponse{
+		Firewall: hcloud.SchemaFromFirewall(firewall),
+		Actions:  []schema.Action{},
+	})
+}
+
+func (s *Server) deleteFirewall(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	firewall := s.firewallByID(id)
+	if firewall == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "firewall not found")
+		return
+	}
+	if len(firewall.AppliedTo) > 0 {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeResourceInUse, "firewall is still in use")
+		return
+	}
+
+	s.firewalls = slices.DeleteFunc(s.firewalls, func(f *hcloud.Firewall) bool {
+		return f.ID == id
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setFirewallRules(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	firewall := s.firewallByID(id)
+	if firewall == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "firewall not found")
+		return
+	}
+
+	var req schema.FirewallActionSetRulesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	rules, err := firewallRulesFromRequest(req.Rules)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput, err.Error())
+		return
+	}
+
+	a := s.newAction("set_firewall_rules", firewall.ID, hcloud.ActionResourceType("firewall"), func() {
+		firewall.Rules = rules
+	})
+
+	writeJSON(w, http.StatusCreated, schema.FirewallActionSetRulesResponse{
+		Actions: hcloud.SchemaFromActions([]*hcloud.Action{a}),
+	})
+}
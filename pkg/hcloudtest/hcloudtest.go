@@ -0,0 +1,442 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hcloudtest provides an in-process fake of the subset of the Hetzner
+// Cloud API used by the provider, so commands can be tested end to end
+// without a network connection or a real token
+package hcloudtest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+type action struct {
+	*hcloud.Action
+
+	polls      int
+	onComplete func()
+}
+
+type Server struct {
+	*httptest.Server
+
+	// ActionSteps is the number of times an action must be polled before it
+	// succeeds. Resources only change state once their action has completed.
+	ActionSteps int
+
+	// IPv4 is the public IP address given to new servers
+	IPv4 net.IP
+
+	// IPv6 is the public IPv6 network given to new servers
+	IPv6 *net.IPNet
+
+	mu              sync.Mutex
+	nextID          int64
+	actions         map[int64]*action
+	datacenters     []*hcloud.Datacenter
+	firewalls       []*hcloud.Firewall
+	images          []*hcloud.Image
+	locations       []*hcloud.Location
+	networks        []*hcloud.Network
+	placementGroups []*hcloud.PlacementGroup
+	primaryIPs      []*hcloud.PrimaryIP
+	servers         []*hcloud.Server
+	serverTypes     []*hcloud.ServerType
+	sshKeys         []*hcloud.SSHKey
+	userData        map[int64]string
+	volumes         []*hcloud.Volume
+}
+
+// NewServer starts a fake Hetzner Cloud API seeded with the nbg1 location and
+// its nbg1-dc3 datacenter, the cx22 and cax11 server types, the docker-ce and
+// debian-12 images and a "devpod" private network on 10.0.0.0/16. It is
+// stopped when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	location := &hcloud.Location{ID: 1, Name: "nbg1", City: "Nuremberg", NetworkZone: hcloud.NetworkZoneEUCentral}
+
+	s := &Server{
+		ActionSteps: 2,
+		IPv4:        net.ParseIP("127.0.0.1"),
+		IPv6:        &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)},
+		nextID:      1000,
+		actions:     map[int64]*action{},
+		userData:    map[int64]string{},
+		images: []*hcloud.Image{
+			{
+				ID:           1,
+				Name:         "docker-ce",
+				Type:         hcloud.ImageTypeApp,
+				OSFlavor:     "ubuntu",
+				Status:       hcloud.ImageStatusAvailable,
+				Architecture: hcloud.ArchitectureX86,
+			},
+			{
+				ID:           2,
+				Name:         "docker-ce",
+				Type:         hcloud.ImageTypeApp,
+				OSFlavor:     "ubuntu",
+				Status:       hcloud.ImageStatusAvailable,
+				Architecture: hcloud.ArchitectureARM,
+			},
+			{
+				ID:           3,
+				Name:         "debian-12",
+				Type:         hcloud.ImageTypeSystem,
+				OSFlavor:     "debian",
+				Status:       hcloud.ImageStatusAvailable,
+				Architecture: hcloud.ArchitectureX86,
+			},
+		},
+		locations: []*hcloud.Location{location},
+		datacenters: []*hcloud.Datacenter{
+			{ID: 1, Name: "nbg1-dc3", Location: location},
+		},
+		networks: []*hcloud.Network{
+			{ID: 1, Name: "devpod", IPRange: &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(16, 32)}},
+		},
+		serverTypes: []*hcloud.ServerType{
+			{
+				ID:           1,
+				Name:         "cx22",
+				Cores:        2,
+				Memory:       4,
+				Disk:         40,
+				Architecture: hcloud.ArchitectureX86,
+			},
+			{
+				ID:           2,
+				Name:         "cax11",
+				Cores:        2,
+				Memory:       4,
+				Disk:         40,
+				Architecture: hcloud.ArchitectureARM,
+			},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /actions/{id}", s.getAction)
+	mux.HandleFunc("GET /datacenters", s.listDatacenters)
+	mux.HandleFunc("GET /firewalls", s.listFirewalls)
+	mux.HandleFunc("POST /firewalls", s.createFirewall)
+	mux.HandleFunc("DELETE /firewalls/{id}", s.deleteFirewall)
+	mux.HandleFunc("POST /firewalls/{id}/actions/set_rules", s.setFirewallRules)
+	mux.HandleFunc("GET /images", s.listImages)
+	mux.HandleFunc("DELETE /images/{id}", s.deleteImage)
+	mux.HandleFunc("GET /locations", s.listLocations)
+	mux.HandleFunc("GET /networks", s.listNetworks)
+	mux.HandleFunc("GET /networks/{id}", s.getNetwork)
+	mux.HandleFunc("GET /placement_groups", s.listPlacementGroups)
+	mux.HandleFunc("POST /placement_groups", s.createPlacementGroup)
+	mux.HandleFunc("GET /placement_groups/{id}", s.getPlacementGroup)
+	mux.HandleFunc("DELETE /placement_groups/{id}", s.deletePlacementGroup)
+	mux.HandleFunc("GET /primary_ips", s.listPrimaryIPs)
+	mux.HandleFunc("POST /primary_ips", s.createPrimaryIP)
+	mux.HandleFunc("DELETE /primary_ips/{id}", s.deletePrimaryIP)
+	mux.HandleFunc("GET /server_types", s.listServerTypes)
+	mux.HandleFunc("GET /servers", s.listServers)
+	mux.HandleFunc("POST /servers", s.createServer)
+	mux.HandleFunc("DELETE /servers/{id}", s.deleteServer)
+	mux.HandleFunc("POST /servers/{id}/actions/attach_to_network", s.attachToNetwork)
+	mux.HandleFunc("POST /servers/{id}/actions/create_image", s.createImage)
+	mux.HandleFunc("POST /servers/{id}/actions/poweroff", s.serverAction("stop_server", hcloud.ServerStatusOff))
+	mux.HandleFunc("POST /servers/{id}/actions/poweron", s.serverAction("start_server", hcloud.ServerStatusRunning))
+	mux.HandleFunc("POST /servers/{id}/actions/shutdown", s.serverAction("shutdown_server", hcloud.ServerStatusOff))
+	mux.HandleFunc("GET /ssh_keys", s.listSSHKeys)
+	mux.HandleFunc("POST /ssh_keys", s.createSSHKey)
+	mux.HandleFunc("DELETE /ssh_keys/{id}", s.deleteSSHKey)
+	mux.HandleFunc("GET /volumes", s.listVolumes)
+	mux.HandleFunc("POST /volumes", s.createVolume)
+	mux.HandleFunc("GET /volumes/{id}", s.getVolume)
+	mux.HandleFunc("DELETE /volumes/{id}", s.deleteVolume)
+	mux.HandleFunc("POST /volumes/{id}/actions/attach", s.attachVolumeAction)
+	mux.HandleFunc("POST /volumes/{id}/actions/detach", s.detachVolume)
+	mux.HandleFunc("POST /volumes/{id}/actions/resize", s.resizeVolume)
+
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Endpoint is the URL to pass to hcloud.WithEndpoint
+func (s *Server) Endpoint() string {
+	return s.URL
+}
+
+// Images returns the images that currently exist, including snapshots
+func (s *Server) Images() []*hcloud.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.Image{}, s.images...)
+}
+
+// Servers returns the servers that currently exist
+func (s *Server) Servers() []*hcloud.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.Server{}, s.servers...)
+}
+
+// SSHKeys returns the SSH keys that currently exist
+func (s *Server) SSHKeys() []*hcloud.SSHKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.SSHKey{}, s.sshKeys...)
+}
+
+// UserData returns the user data the named server was created with
+func (s *Server) UserData(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if server := s.serverByName(name); server != nil {
+		return s.userData[server.ID]
+	}
+	return ""
+}
+
+// Volumes returns the volumes that currently exist
+func (s *Server) Volumes() []*hcloud.Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.Volume{}, s.volumes...)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, hcloud.ErrorCodeUnauthorized, "unable to authenticate")
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) id() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+// newAction registers a running action. The onComplete function is called
+// once the action has been polled ActionSteps times.
+func (s *Server) newAction(command string, resourceID int64, resourceType hcloud.ActionResourceType, onComplete func()) *hcloud.Action {
+	a := &action{
+		Action: &hcloud.Action{
+			ID:      s.id(),
+			Command: command,
+			Status:  hcloud.ActionStatusRunning,
+			Started: time.Now(),
+			Resources: []*hcloud.ActionResource{
+				{ID: resourceID, Type: resourceType},
+			},
+		},
+		onComplete: onComplete,
+	}
+	s.actions[a.ID] = a
+
+	return a.Action
+}
+
+func (s *Server) getAction(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	a, ok := s.actions[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "action not found")
+		return
+	}
+
+	if a.Status == hcloud.ActionStatusRunning {
+		a.polls++
+		a.Progress = min(100, a.polls*100/max(1, s.ActionSteps))
+
+		if a.polls >= s.ActionSteps {
+			a.Status = hcloud.ActionStatusSuccess
+			a.Finished = time.Now()
+			if a.onComplete != nil {
+				a.onComplete()
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"action": hcloud.SchemaFromAction(a.Action),
+	})
+}
+
+func (s *Server) listImages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	images := make([]schema.Image, 0)
+	for _, i := range s.images {
+		if q.Has("name") && i.Name != q.Get("name") {
+			continue
+		}
+		if q.Has("architecture") && string(i.Architecture) != q.Get("architecture") {
+			continue
+		}
+		if q.Has("type") && !slices.Contains(q["type"], string(i.Type)) {
+			continue
+		}
+		if !matchesLabels(i.Labels, q.Get("label_selector")) {
+			continue
+		}
+		images = append(images, hcloud.SchemaFromImage(i))
+	}
+
+	writeList(w, "images", images, len(images))
+}
+
+func (s *Server) deleteImage(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	if !slices.ContainsFunc(s.images, func(i *hcloud.Image) bool { return i.ID == id }) {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "image not found")
+		return
+	}
+
+	s.images = slices.DeleteFunc(s.images, func(i *hcloud.Image) bool {
+		return i.ID == id
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listDatacenters(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	datacenters := make([]schema.Datacenter, 0)
+	for _, d := range s.datacenters {
+		if q.Has("name") && d.Name != q.Get("name") {
+			continue
+		}
+		datacenters = append(datacenters, hcloud.SchemaFromDatacenter(d))
+	}
+
+	writeList(w, "datacenters", datacenters, len(datacenters))
+}
+
+func (s *Server) datacenterInLocation(location *hcloud.Location) *hcloud.Datacenter {
+	for _, d := range s.datacenters {
+		if d.Location.ID == location.ID {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *Server) listLocations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	locations := make([]schema.Location, 0)
+	for _, l := range s.locations {
+		if q.Has("name") && l.Name != q.Get("name") {
+			continue
+		}
+		locations = append(locations, hcloud.SchemaFromLocation(l))
+	}
+
+	writeList(w, "locations", locations, len(locations))
+}
+
+func (s *Server) listServerTypes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	serverTypes := make([]schema.ServerType, 0)
+	for _, t := range s.serverTypes {
+		if q.Has("name") && t.Name != q.Get("name") {
+			continue
+		}
+		serverTypes = append(serverTypes, hcloud.SchemaFromServerType(t))
+	}
+
+	writeList(w, "server_types", serverTypes, len(serverTypes))
+}
+
+// matchesLabels implements the equality and existence subset of the label
+// selector syntax
+func matchesLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+
+	for _, term := range strings.Split(selector, ",") {
+		k, v, hasValue := strings.Cut(term, "=")
+		value, ok := labels[k]
+		if !ok || (hasValue && value != v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func pathID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id, err == nil
+}
+
+func writeError(w http.ResponseWriter, status int, code hcloud.ErrorCode, message string) {
+	writeJSON(w, status, schema.ErrorResponse{
+		Error: schema.Error{
+			Code:    string(code),
+			Message: message,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeList(w http.ResponseWriter, key string, items any, total int) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		key: items,
+		"meta": schema.Meta{
+			Pagination: &schema.MetaPagination{
+				Page:         1,
+				PerPage:      max(total, 1),
+				LastPage:     1,
+				TotalEntries: total,
+			},
+		},
+	})
+}
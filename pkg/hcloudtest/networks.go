@@ -0,0 +1,139 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+func (s *Server) networkByID(id int64) *hcloud.Network {
+	for _, network := range s.networks {
+		if network.ID == id {
+			return network
+		}
+	}
+	return nil
+}
+
+// nextNetworkIP returns the next unused IP in the network, skipping the
+// gateway at .1
+func (s *Server) nextNetworkIP(network *hcloud.Network) net.IP {
+	used := 0
+	for _, server := range s.servers {
+		for _, p := range server.PrivateNet {
+			if p.Network.ID == network.ID {
+				used++
+			}
+		}
+	}
+
+	ip := network.IPRange.IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]+byte(2+used))
+}
+
+func (s *Server) joinNetwork(server *hcloud.Server, network *hcloud.Network, ip net.IP) {
+	if ip == nil {
+		ip = s.nextNetworkIP(network)
+	}
+
+	server.PrivateNet = append(server.PrivateNet, hcloud.ServerPrivateNet{
+		Network: network,
+		IP:      ip,
+	})
+	network.Servers = append(network.Servers, server)
+}
+
+func (s *Server) listNetworks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	networks := make([]schema.Network, 0)
+	for _, network := range s.networks {
+		if q.Has("name") && network.Name != q.Get("name") {
+			continue
+		}
+		if !matchesLabels(network.Labels, q.Get("label_selector")) {
+			continue
+		}
+		networks = append(networks, hcloud.SchemaFromNetwork(network))
+	}
+
+	writeList(w, "networks", networks, len(networks))
+}
+
+func (s *Server) getNetwork(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	network := s.networkByID(id)
+	if network == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "network not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schema.NetworkGetResponse{
+		Network: hcloud.SchemaFromNetwork(network),
+	})
+}
+
+func (s *Server) attachToNetwork(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	server := s.serverByID(id)
+	if server == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server not found")
+		return
+	}
+
+	var req schema.ServerActionAttachToNetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	network := s.networkByID(req.Network)
+	if network == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "network not found")
+		return
+	}
+
+	for _, p := range server.PrivateNet {
+		if p.Network.ID == network.ID {
+			writeError(w, http.StatusConflict, hcloud.ErrorCodeServerAlreadyAttached, "server is already attached to network")
+			return
+		}
+	}
+
+	var ip net.IP
+	if req.IP != nil {
+		if ip = net.ParseIP(*req.IP); ip == nil || !network.IPRange.Contains(ip) {
+			writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput, "ip is not in the network range")
+			return
+		}
+	}
+
+	a := s.newAction("attach_to_network", server.ID, hcloud.ActionResourceTypeServer, func() {
+		s.joinNetwork(server, network, ip)
+	})
+
+	writeJSON(w, http.StatusCreated, schema.ServerActionAttachToNetworkResponse{
+		Action: hcloud.SchemaFromAction(a),
+	})
+}
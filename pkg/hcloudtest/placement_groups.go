@@ -0,0 +1,134 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// PlacementGroups returns the placement groups that currently exist
+func (s *Server) PlacementGroups() []*hcloud.PlacementGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.PlacementGroup{}, s.placementGroups...)
+}
+
+func (s *Server) placementGroupByID(id int64) *hcloud.PlacementGroup {
+	for _, placementGroup := range s.placementGroups {
+		if placementGroup.ID == id {
+			return placementGroup
+		}
+	}
+	return nil
+}
+
+// leavePlacementGroup removes the server from its placement group, as
+// happens when it is deleted
+func leavePlacementGroup(server *hcloud.Server) {
+	if server.PlacementGroup == nil {
+		return
+	}
+
+	server.PlacementGroup.Servers = slices.DeleteFunc(server.PlacementGroup.Servers, func(id int64) bool {
+		return id == server.ID
+	})
+}
+
+func (s *Server) listPlacementGroups(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	placementGroups := make([]schema.PlacementGroup, 0)
+	for _, placementGroup := range s.placementGroups {
+		if q.Has("name") && placementGroup.Name != q.Get("name") {
+			continue
+		}
+		if !matchesLabels(placementGroup.Labels, q.Get("label_selector")) {
+			continue
+		}
+		placementGroups = append(placementGroups, hcloud.SchemaFromPlacementGroup(placementGroup))
+	}
+
+	writeList(w, "placement_groups", placementGroups, len(placementGroups))
+}
+
+func (s *Server) getPlacementGroup(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	placementGroup := s.placementGroupByID(id)
+	if placementGroup == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "placement group not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schema.PlacementGroupGetResponse{
+		PlacementGroup: hcloud.SchemaFromPlacementGroup(placementGroup),
+	})
+}
+
+func (s *Server) createPlacementGroup(w http.ResponseWriter, r *http.Request) {
+	var req schema.PlacementGroupCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	if slices.ContainsFunc(s.placementGroups, func(p *hcloud.PlacementGroup) bool { return p.Name == req.Name }) {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "placement group name is already used")
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	placementGroup := &hcloud.PlacementGroup{
+		ID:      s.id(),
+		Name:    req.Name,
+		Labels:  labels,
+		Created: time.Now(),
+		Servers: []int64{},
+		Type:    hcloud.PlacementGroupType(req.Type),
+	}
+	s.placementGroups = append(s.placementGroups, placementGroup)
+
+	writeJSON(w, http.StatusCreated, schema.PlacementGroupCreateResponse{
+		PlacementGroup: hcloud.SchemaFromPlacementGroup(placementGroup),
+	})
+}
+
+func (s *Server) deletePlacementGroup(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	if s.placementGroupByID(id) == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "placement group not found")
+		return
+	}
+
+	s.placementGroups = slices.DeleteFunc(s.placementGroups, func(p *hcloud.PlacementGroup) bool {
+		return p.ID == id
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// PrimaryIPs returns the Primary IPs that currently exist
+func (s *Server) PrimaryIPs() []*hcloud.PrimaryIP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*hcloud.PrimaryIP{}, s.primaryIPs...)
+}
+
+func (s *Server) primaryIPByID(id int64) *hcloud.PrimaryIP {
+	for _, ip := range s.primaryIPs {
+		if ip.ID == id {
+			return ip
+		}
+	}
+	return nil
+}
+
+// assignablePrimaryIP finds a Primary IP to create a server with, writing an
+// error if it can't be used
+func (s *Server) assignablePrimaryIP(
+	w http.ResponseWriter,
+	id int64,
+	ipType hcloud.PrimaryIPType,
+	datacenter *hcloud.Datacenter,
+) *hcloud.PrimaryIP {
+	ip := s.primaryIPByID(id)
+	switch {
+	case ip == nil:
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("primary ip %d not found", id))
+	case ip.Type != ipType:
+		writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodePrimaryIPVersionMismatch, "primary ip has the wrong ip version")
+	case ip.Datacenter.ID != datacenter.ID:
+		writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodePrimaryIPDatacenterMismatch, "primary ip is in a different datacenter")
+	case ip.AssigneeID != 0:
+		writeError(w, http.StatusConflict, hcloud.ErrorCodePrimaryIPAssigned, "primary ip is already assigned")
+	default:
+		return ip
+	}
+	return nil
+}
+
+// unassignPrimaryIPs releases the server's Primary IPs, as happens when it is
+// deleted. Those set to auto delete are deleted with it.
+func (s *Server) unassignPrimaryIPs(server *hcloud.Server) {
+	s.primaryIPs = slices.DeleteFunc(s.primaryIPs, func(ip *hcloud.PrimaryIP) bool {
+		if ip.AssigneeID != server.ID {
+			return false
+		}
+		ip.AssigneeID = 0
+		return ip.AutoDelete
+	})
+}
+
+func (s *Server) listPrimaryIPs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	primaryIPs := make([]schema.PrimaryIP, 0)
+	for _, ip := range s.primaryIPs {
+		if q.Has("name") && ip.Name != q.Get("name") {
+			continue
+		}
+		if !matchesLabels(ip.Labels, q.Get("label_selector")) {
+			continue
+		}
+		primaryIPs = append(primaryIPs, hcloud.SchemaFromPrimaryIP(ip))
+	}
+
+	writeList(w, "primary_ips", primaryIPs, len(primaryIPs))
+}
+
+func (s *Server) createPrimaryIP(w http.ResponseWriter, r *http.Request) {
+	var req schema.PrimaryIPCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	if slices.ContainsFunc(s.primaryIPs, func(ip *hcloud.PrimaryIP) bool { return ip.Name == req.Name }) {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "primary ip name is already used")
+		return
+	}
+
+	var datacenter *hcloud.Datacenter
+	for _, d := range s.datacenters {
+		if d.Name == req.Datacenter {
+			datacenter = d
+		}
+	}
+	if datacenter == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "datacenter not found")
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	primaryIP := &hcloud.PrimaryIP{
+		ID:           s.id(),
+		Name:         req.Name,
+		Type:         hcloud.PrimaryIPType(req.Type),
+		Labels:       labels,
+		AssigneeType: req.AssigneeType,
+		AutoDelete:   req.AutoDelete != nil && *req.AutoDelete,
+		Created:      time.Now(),
+		Datacenter:   datacenter,
+	}
+	switch primaryIP.Type {
+	case hcloud.PrimaryIPTypeIPv4:
+		primaryIP.IP = s.IPv4
+	case hcloud.PrimaryIPTypeIPv6:
+		primaryIP.IP = s.IPv6.IP
+		primaryIP.Network = s.IPv6
+	default:
+		writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput, fmt.Sprintf("invalid type %q", req.Type))
+		return
+	}
+	s.primaryIPs = append(s.primaryIPs, primaryIP)
+
+	writeJSON(w, http.StatusCreated, schema.PrimaryIPCreateResponse{
+		PrimaryIP: hcloud.SchemaFromPrimaryIP(primaryIP),
+	})
+}
+
+func (s *Server) deletePrimaryIP(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	ip := s.primaryIPByID(id)
+	if ip == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "primary ip not found")
+		return
+	}
+	if ip.AssigneeID != 0 {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeConflict, "primary ip must be unassigned")
+		return
+	}
+
+	s.primaryIPs = slices.DeleteFunc(s.primaryIPs, func(i *hcloud.PrimaryIP) bool {
+		return i.ID == id
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func publicNetIPv4(ip *hcloud.PrimaryIP) hcloud.ServerPublicNetIPv4 {
+	return hcloud.ServerPublicNetIPv4{ID: ip.ID, IP: ip.IP}
+}
+
+func publicNetIPv6(ip *hcloud.PrimaryIP) hcloud.ServerPublicNetIPv6 {
+	return hcloud.ServerPublicNetIPv6{ID: ip.ID, IP: ip.IP, Network: ip.Network}
+}
@@ -0,0 +1,380 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+func (s *Server) serverByID(id int64) *hcloud.Server {
+	for _, server := range s.servers {
+		if server.ID == id {
+			return server
+		}
+	}
+	return nil
+}
+
+func (s *Server) serverByName(name string) *hcloud.Server {
+	for _, server := range s.servers {
+		if server.Name == name {
+			return server
+		}
+	}
+	return nil
+}
+
+func (s *Server) listServers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	servers := make([]schema.Server, 0)
+	for _, server := range s.servers {
+		if q.Has("name") && server.Name != q.Get("name") {
+			continue
+		}
+		if q.Has("status") && !slices.Contains(q["status"], string(server.Status)) {
+			continue
+		}
+		if !matchesLabels(server.Labels, q.Get("label_selector")) {
+			continue
+		}
+		servers = append(servers, hcloud.SchemaFromServer(server))
+	}
+
+	writeList(w, "servers", servers, len(servers))
+}
+
+//nolint:funlen // validates each referenced resource in turn
+func (s *Server) createServer(w http.ResponseWriter, r *http.Request) {
+	var req schema.ServerCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	if s.serverByName(req.Name) != nil {
+		writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "server name is already used")
+		return
+	}
+
+	serverType := s.serverTypeByIDOrName(req.ServerType)
+	if serverType == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server type not found")
+		return
+	}
+
+	image := s.imageByIDOrName(req.Image, serverType.Architecture)
+	if image == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "image not found")
+		return
+	}
+
+	// The location is sent as either its ID or its name
+	locationRef := schema.IDOrName{Name: req.Location}
+	if id, err := strconv.ParseInt(req.Location, 10, 64); err == nil {
+		locationRef = schema.IDOrName{ID: id}
+	}
+	location := s.locationByIDOrName(locationRef)
+	if location == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "location not found")
+		return
+	}
+
+	for _, id := range req.SSHKeys {
+		if s.sshKeyByID(id) == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("ssh key %d not found", id))
+			return
+		}
+	}
+
+	volumes := make([]*hcloud.Volume, 0, len(req.Volumes))
+	for _, id := range req.Volumes {
+		volume := s.volumeByID(id)
+		if volume == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("volume %d not found", id))
+			return
+		}
+		if volume.Server != nil {
+			writeError(w, http.StatusLocked, hcloud.ErrorCodeLocked, fmt.Sprintf("volume %d is already attached", id))
+			return
+		}
+		volumes = append(volumes, volume)
+	}
+
+	networks := make([]*hcloud.Network, 0, len(req.Networks))
+	for _, id := range req.Networks {
+		network := s.networkByID(id)
+		if network == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("network %d not found", id))
+			return
+		}
+		networks = append(networks, network)
+	}
+
+	firewalls := make([]*hcloud.Firewall, 0, len(req.Firewalls))
+	for _, f := range req.Firewalls {
+		firewall := s.firewallByID(f.Firewall)
+		if firewall == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("firewall %d not found", f.Firewall))
+			return
+		}
+		firewalls = append(firewalls, firewall)
+	}
+
+	var placementGroup *hcloud.PlacementGroup
+	if req.PlacementGroup != 0 {
+		if placementGroup = s.placementGroupByID(req.PlacementGroup); placementGroup == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, fmt.Sprintf("placement group %d not found", req.PlacementGroup))
+			return
+		}
+	}
+
+	datacenter := s.datacenterInLocation(location)
+
+	publicNet := hcloud.ServerPublicNet{
+		IPv4: hcloud.ServerPublicNetIPv4{ID: s.id(), IP: s.IPv4},
+		IPv6: hcloud.ServerPublicNetIPv6{ID: s.id(), IP: s.IPv6.IP, Network: s.IPv6},
+	}
+	primaryIPs := make([]*hcloud.PrimaryIP, 0)
+	if req.PublicNet != nil {
+		if !req.PublicNet.EnableIPv4 && !req.PublicNet.EnableIPv6 && len(networks) == 0 {
+			writeError(w, http.StatusUnprocessableEntity, hcloud.ErrorCodeInvalidInput, "a server without public IPs must be attached to a network")
+			return
+		}
+		if !req.PublicNet.EnableIPv4 {
+			publicNet.IPv4 = hcloud.ServerPublicNetIPv4{}
+		} else if req.PublicNet.IPv4ID != 0 {
+			ip := s.assignablePrimaryIP(w, req.PublicNet.IPv4ID, hcloud.PrimaryIPTypeIPv4, datacenter)
+			if ip == nil {
+				return
+			}
+			publicNet.IPv4 = publicNetIPv4(ip)
+			primaryIPs = append(primaryIPs, ip)
+		}
+		if !req.PublicNet.EnableIPv6 {
+			publicNet.IPv6 = hcloud.ServerPublicNetIPv6{}
+		} else if req.PublicNet.IPv6ID != 0 {
+			ip := s.assignablePrimaryIP(w, req.PublicNet.IPv6ID, hcloud.PrimaryIPTypeIPv6, datacenter)
+			if ip == nil {
+				return
+			}
+			publicNet.IPv6 = publicNetIPv6(ip)
+			primaryIPs = append(primaryIPs, ip)
+		}
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	server := &hcloud.Server{
+		ID:         s.id(),
+		Name:       req.Name,
+		Status:     hcloud.ServerStatusInitializing,
+		Created:    time.Now(),
+		ServerType: serverType,
+		Image:      image,
+		Datacenter: datacenter,
+		Labels:     labels,
+		PublicNet:  publicNet,
+	}
+	if placementGroup != nil {
+		server.PlacementGroup = placementGroup
+		placementGroup.Servers = append(placementGroup.Servers, server.ID)
+	}
+	for _, network := range networks {
+		s.joinNetwork(server, network, nil)
+	}
+	for _, firewall := range firewalls {
+		applyFirewall(firewall, server)
+	}
+	for _, ip := range primaryIPs {
+		ip.AssigneeID = server.ID
+	}
+	s.servers = append(s.servers, server)
+	s.userData[server.ID] = req.UserData
+
+	start := req.StartAfterCreate == nil || *req.StartAfterCreate
+
+	createAction := s.newAction("create_server", server.ID, hcloud.ActionResourceTypeServer, func() {
+		server.Status = hcloud.ServerStatusOff
+		if start {
+			server.Status = hcloud.ServerStatusRunning
+		}
+	})
+
+	nextActions := []*hcloud.Action{}
+	if start {
+		nextActions = append(nextActions, s.newAction("start_server", server.ID, hcloud.ActionResourceTypeServer, nil))
+	}
+	for _, volume := range volumes {
+		nextActions = append(nextActions, s.newAction("attach_volume", volume.ID, hcloud.ActionResourceTypeVolume, func() {
+			s.attachVolume(volume, server)
+		}))
+	}
+
+	writeJSON(w, http.StatusCreated, schema.ServerCreateResponse{
+		Server:      hcloud.SchemaFromServer(server),
+		Action:      hcloud.SchemaFromAction(createAction),
+		NextActions: hcloud.SchemaFromActions(nextActions),
+	})
+}
+
+func (s *Server) deleteServer(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	server := s.serverByID(id)
+	if server == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server not found")
+		return
+	}
+
+	server.Status = hcloud.ServerStatusDeleting
+
+	deleteAction := s.newAction("delete_server", server.ID, hcloud.ActionResourceTypeServer, func() {
+		// Deleting a server detaches its volumes, networks, firewalls, primary IPs
+		// and placement group
+		for _, volume := range server.Volumes {
+			volume.Server = nil
+		}
+		s.removeFirewalls(server)
+		s.unassignPrimaryIPs(server)
+		leavePlacementGroup(server)
+		for _, p := range server.PrivateNet {
+			p.Network.Servers = slices.DeleteFunc(p.Network.Servers, func(i *hcloud.Server) bool {
+				return i.ID == server.ID
+			})
+		}
+
+		s.servers = slices.DeleteFunc(s.servers, func(i *hcloud.Server) bool {
+			return i.ID == server.ID
+		})
+		delete(s.userData, server.ID)
+	})
+
+	writeJSON(w, http.StatusOK, schema.ServerDeleteResponse{
+		Action: hcloud.SchemaFromAction(deleteAction),
+	})
+}
+
+func (s *Server) serverTypeByIDOrName(ref schema.IDOrName) *hcloud.ServerType {
+	for _, t := range s.serverTypes {
+		if t.ID == ref.ID || t.Name == ref.Name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Server) imageByIDOrName(ref schema.IDOrName, architecture hcloud.Architecture) *hcloud.Image {
+	for _, i := range s.images {
+		if i.ID == ref.ID || (i.Name == ref.Name && i.Architecture == architecture) {
+			return i
+		}
+	}
+	return nil
+}
+
+func (s *Server) locationByIDOrName(ref schema.IDOrName) *hcloud.Location {
+	for _, l := range s.locations {
+		if l.ID == ref.ID || l.Name == ref.Name {
+			return l
+		}
+	}
+	return nil
+}
+
+// serverAction registers a handler for a server action which changes the
+// server's status once the action has completed
+func (s *Server) serverAction(command string, status hcloud.ServerStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := pathID(r)
+
+		server := s.serverByID(id)
+		if server == nil {
+			writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server not found")
+			return
+		}
+
+		a := s.newAction(command, server.ID, hcloud.ActionResourceTypeServer, func() {
+			server.Status = status
+		})
+
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"action": hcloud.SchemaFromAction(a),
+		})
+	}
+}
+
+func (s *Server) createImage(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	server := s.serverByID(id)
+	if server == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server not found")
+		return
+	}
+
+	var req schema.ServerActionCreateImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	description := ""
+	if req.Description != nil {
+		description = *req.Description
+	}
+
+	image := &hcloud.Image{
+		ID:           s.id(),
+		Type:         hcloud.ImageTypeSnapshot,
+		Status:       hcloud.ImageStatusCreating,
+		Description:  description,
+		Architecture: server.ServerType.Architecture,
+		Labels:       labels,
+		Created:      time.Now(),
+		CreatedFrom:  &hcloud.Server{ID: server.ID, Name: server.Name},
+	}
+	if req.Type != nil {
+		image.Type = hcloud.ImageType(*req.Type)
+	}
+	s.images = append(s.images, image)
+
+	a := s.newAction("create_image", server.ID, hcloud.ActionResourceTypeServer, func() {
+		image.Status = hcloud.ImageStatusAvailable
+	})
+
+	writeJSON(w, http.StatusCreated, schema.ServerActionCreateImageResponse{
+		Action: hcloud.SchemaFromAction(a),
+		Image:  hcloud.SchemaFromImage(image),
+	})
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CommandHandler runs a command received over SSH and returns its exit status
+type CommandHandler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// SSHServer is a fake of the SSH daemon running on a provisioned server. It
+// accepts any public key. Port forwards are always connected back to the
+// server itself, so it can also act as its own jump host.
+type SSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu       sync.Mutex
+	handler  CommandHandler
+	commands []string
+	forwards []string
+}
+
+// NewSSHServer starts an SSH server on a random local port. It is stopped
+// when the test finishes.
+func NewSSHServer(t testing.TB) *SSHServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("create host key signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	s := &SSHServer{
+		listener: listener,
+		config:   config,
+		handler:  DefaultCommandHandler,
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go s.serve()
+
+	return s
+}
+
+// DefaultCommandHandler reports cloud-init as having finished and echoes the
+// command for anything else
+func DefaultCommandHandler(command string, _ io.Reader, stdout, _ io.Writer) int {
+	if strings.HasPrefix(command, "cloud-init status") {
+		_, _ = fmt.Fprintln(stdout, "status: done")
+		return 0
+	}
+
+	_, _ = fmt.Fprintln(stdout, command)
+	return 0
+}
+
+// Port is the port the server is listening on
+func (s *SSHServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Commands returns every command that has been run, in order
+func (s *SSHServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.commands...)
+}
+
+// Forwards returns the address of every port forward requested, in order
+func (s *SSHServer) Forwards() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.forwards...)
+}
+
+// SetHandler replaces the command handler
+func (s *SSHServer) SetHandler(handler CommandHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handler = handler
+}
+
+func (s *SSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *SSHServer) handleConn(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+
+			go s.handleSession(channel, requests)
+		case "direct-tcpip":
+			go s.handleForward(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// handleForward records the requested address and proxies the channel to
+// this server
+func (s *SSHServer) handleForward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.forwards = append(s.forwards, net.JoinHostPort(payload.Host, strconv.FormatUint(uint64(payload.Port), 10)))
+	s.mu.Unlock()
+
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(channel, conn)
+	_ = channel.Close()
+}
+
+func (s *SSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() {
+		_ = channel.Close()
+	}()
+
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			_ = req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				return
+			}
+			_ = req.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			handler := s.handler
+			s.mu.Unlock()
+
+			status := handler(payload.Command, channel, channel, channel.Stderr())
+
+			//nolint:gosec // exit statuses are always small
+			_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
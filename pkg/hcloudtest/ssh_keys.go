@@ -0,0 +1,114 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"golang.org/x/crypto/ssh"
+)
+
+func (s *Server) sshKeyByID(id int64) *hcloud.SSHKey {
+	for _, key := range s.sshKeys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *Server) listSSHKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	keys := make([]schema.SSHKey, 0)
+	for _, key := range s.sshKeys {
+		if q.Has("name") && key.Name != q.Get("name") {
+			continue
+		}
+		if q.Has("fingerprint") && key.Fingerprint != q.Get("fingerprint") {
+			continue
+		}
+		if !matchesLabels(key.Labels, q.Get("label_selector")) {
+			continue
+		}
+		keys = append(keys, hcloud.SchemaFromSSHKey(key))
+	}
+
+	writeList(w, "ssh_keys", keys, len(keys))
+}
+
+func (s *Server) createSSHKey(w http.ResponseWriter, r *http.Request) {
+	var req schema.SSHKeyCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	//nolint:dogsled // only the key is required
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeInvalidInput, "invalid public key")
+		return
+	}
+	fingerprint := ssh.FingerprintLegacyMD5(pk)
+
+	for _, key := range s.sshKeys {
+		if key.Name == req.Name || key.Fingerprint == fingerprint {
+			writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "SSH key is not unique")
+			return
+		}
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	key := &hcloud.SSHKey{
+		ID:          s.id(),
+		Name:        req.Name,
+		Fingerprint: fingerprint,
+		PublicKey:   req.PublicKey,
+		Labels:      labels,
+		Created:     time.Now(),
+	}
+	s.sshKeys = append(s.sshKeys, key)
+
+	writeJSON(w, http.StatusCreated, schema.SSHKeyCreateResponse{
+		SSHKey: hcloud.SchemaFromSSHKey(key),
+	})
+}
+
+func (s *Server) deleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	if s.sshKeyByID(id) == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "SSH key not found")
+		return
+	}
+
+	s.sshKeys = slices.DeleteFunc(s.sshKeys, func(i *hcloud.SSHKey) bool {
+		return i.ID == id
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
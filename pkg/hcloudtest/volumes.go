@@ -0,0 +1,241 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hcloudtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+func (s *Server) volumeByID(id int64) *hcloud.Volume {
+	for _, volume := range s.volumes {
+		if volume.ID == id {
+			return volume
+		}
+	}
+	return nil
+}
+
+func (s *Server) attachVolume(volume *hcloud.Volume, server *hcloud.Server) {
+	volume.Server = server
+	server.Volumes = append(server.Volumes, volume)
+}
+
+func (s *Server) listVolumes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	volumes := make([]schema.Volume, 0)
+	for _, volume := range s.volumes {
+		if q.Has("name") && volume.Name != q.Get("name") {
+			continue
+		}
+		if !matchesLabels(volume.Labels, q.Get("label_selector")) {
+			continue
+		}
+		volumes = append(volumes, hcloud.SchemaFromVolume(volume))
+	}
+
+	writeList(w, "volumes", volumes, len(volumes))
+}
+
+func (s *Server) createVolume(w http.ResponseWriter, r *http.Request) {
+	var req schema.VolumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	for _, volume := range s.volumes {
+		if volume.Name == req.Name {
+			writeError(w, http.StatusConflict, hcloud.ErrorCodeUniquenessError, "volume name is already used")
+			return
+		}
+	}
+
+	if req.Size < 10 {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeInvalidInput, "volume size must be at least 10 GB")
+		return
+	}
+
+	var location *hcloud.Location
+	if req.Location != nil {
+		location = s.locationByIDOrName(*req.Location)
+	}
+	if location == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "location not found")
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+
+	format := ""
+	if req.Format != nil {
+		format = *req.Format
+	}
+
+	volume := &hcloud.Volume{
+		ID:       s.id(),
+		Name:     req.Name,
+		Status:   hcloud.VolumeStatusCreating,
+		Created:  time.Now(),
+		Location: location,
+		Size:     req.Size,
+		Format:   &format,
+		Labels:   labels,
+	}
+	volume.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", volume.ID)
+	s.volumes = append(s.volumes, volume)
+
+	createAction := s.newAction("create_volume", volume.ID, hcloud.ActionResourceTypeVolume, func() {
+		volume.Status = hcloud.VolumeStatusAvailable
+	})
+
+	writeJSON(w, http.StatusCreated, schema.VolumeCreateResponse{
+		Volume:      hcloud.SchemaFromVolume(volume),
+		Action:      hcloud.Ptr(hcloud.SchemaFromAction(createAction)),
+		NextActions: []schema.Action{},
+	})
+}
+
+func (s *Server) getVolume(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	volume := s.volumeByID(id)
+	if volume == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "volume not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schema.VolumeGetResponse{
+		Volume: hcloud.SchemaFromVolume(volume),
+	})
+}
+
+func (s *Server) deleteVolume(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	volume := s.volumeByID(id)
+	if volume == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "volume not found")
+		return
+	}
+	if volume.Server != nil {
+		writeError(w, http.StatusLocked, hcloud.ErrorCodeLocked, "volume is attached to a server")
+		return
+	}
+
+	s.volumes = slices.DeleteFunc(s.volumes, func(i *hcloud.Volume) bool {
+		return i.ID == volume.ID
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) attachVolumeAction(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	volume := s.volumeByID(id)
+	if volume == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "volume not found")
+		return
+	}
+	if volume.Server != nil {
+		writeError(w, http.StatusLocked, hcloud.ErrorCodeLocked, "volume is already attached")
+		return
+	}
+
+	var req schema.VolumeActionAttachVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	server := s.serverByID(req.Server)
+	if server == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "server not found")
+		return
+	}
+
+	attachAction := s.newAction("attach_volume", volume.ID, hcloud.ActionResourceTypeVolume, func() {
+		s.attachVolume(volume, server)
+	})
+
+	writeJSON(w, http.StatusCreated, schema.VolumeActionAttachVolumeResponse{
+		Action: hcloud.SchemaFromAction(attachAction),
+	})
+}
+
+func (s *Server) detachVolume(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	volume := s.volumeByID(id)
+	if volume == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "volume not found")
+		return
+	}
+
+	detachAction := s.newAction("detach_volume", volume.ID, hcloud.ActionResourceTypeVolume, func() {
+		if volume.Server != nil {
+			volume.Server.Volumes = slices.DeleteFunc(volume.Server.Volumes, func(i *hcloud.Volume) bool {
+				return i.ID == volume.ID
+			})
+		}
+		volume.Server = nil
+	})
+
+	writeJSON(w, http.StatusCreated, schema.VolumeActionDetachVolumeResponse{
+		Action: hcloud.SchemaFromAction(detachAction),
+	})
+}
+
+func (s *Server) resizeVolume(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathID(r)
+
+	volume := s.volumeByID(id)
+	if volume == nil {
+		writeError(w, http.StatusNotFound, hcloud.ErrorCodeNotFound, "volume not found")
+		return
+	}
+
+	var req schema.VolumeActionResizeVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeJSONError, err.Error())
+		return
+	}
+
+	if req.Size <= volume.Size {
+		writeError(w, http.StatusBadRequest, hcloud.ErrorCodeInvalidInput, "volume size can only be increased")
+		return
+	}
+
+	resizeAction := s.newAction("resize_volume", volume.ID, hcloud.ActionResourceTypeVolume, func() {
+		volume.Size = req.Size
+	})
+
+	writeJSON(w, http.StatusCreated, schema.VolumeActionResizeVolumeResponse{
+		Action: hcloud.SchemaFromAction(resizeAction),
+	})
+}
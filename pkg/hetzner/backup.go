@@ -0,0 +1,206 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/ssh"
+)
+
+// backupPaths are the mount paths of the workspace's volumes, relative to
+// the root so the backup can be extracted over the same paths
+func (h *Hetzner) backupPaths() []string {
+	mountPaths := make([]string, 0, len(h.extraVolumes)+1)
+	if h.persistentVolume {
+		mountPaths = append(mountPaths, h.volume.MountPath)
+	}
+	for _, extra := range h.extraVolumes {
+		mountPaths = append(mountPaths, extra.Path)
+	}
+
+	paths := make([]string, 0, len(mountPaths))
+	for _, p := range mountPaths {
+		paths = append(paths, "."+path.Clean(p))
+	}
+	return paths
+}
+
+// backupCommand streams a compressed tarball of the volumes to stdout. GNU
+// tar exits 1 when files change while they're read, which is expected of a
+// running workspace and still leaves a usable archive.
+func (h *Hetzner) backupCommand() string {
+	return fmt.Sprintf("sudo -n tar -C / -czf - %s || [ $? -eq 1 ]", shellQuoteAll(h.backupPaths()))
+}
+
+// restoreCommand extracts a tarball from stdin over the volumes, keeping the
+// owners and permissions it was backed up with. Only the volumes' paths are
+// extracted, whatever else is in the archive.
+func (h *Hetzner) restoreCommand() string {
+	return fmt.Sprintf("sudo -n tar -C / --same-owner -xzpf - %s", shellQuoteAll(h.backupPaths()))
+}
+
+// Backup writes a compressed tarball of the workspace's volumes to w
+func (h *Hetzner) Backup(ctx context.Context, server *hcloud.Server, privateKeyFile []byte, w io.Writer) error {
+	if len(h.backupPaths()) == 0 {
+		return ErrNoVolumes
+	}
+	if err := h.runOnVolume(ctx, server, privateKeyFile, h.backupCommand(), &bytes.Buffer{}, w); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	return nil
+}
+
+// Restore extracts a tarball created by Backup over the workspace's volumes.
+// Files in the backup replace those on the server, but files that aren't in
+// the backup are left alone. The archive is checked as it's streamed, and the
+// restore fails if it has anything outside the volumes.
+func (h *Hetzner) Restore(ctx context.Context, server *hcloud.Server, privateKeyFile []byte, r io.Reader) error {
+	paths := h.backupPaths()
+	if len(paths) == 0 {
+		return ErrNoVolumes
+	}
+
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		err := checkArchive(io.TeeReader(r, pw), paths)
+		pw.CloseWithError(err)
+		checked <- err
+	}()
+
+	err := h.runOnVolume(ctx, server, privateKeyFile, h.restoreCommand(), pr, &bytes.Buffer{})
+	// Stop the check if the command exits without reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	if checkErr := <-checked; checkErr != nil && !errors.Is(checkErr, io.ErrClosedPipe) {
+		err = checkErr
+	}
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+// checkArchive reads a compressed tarball, failing if any of its entries
+// are outside the paths or could be used to write outside them, such as an
+// absolute path, a ".." element or a file beneath a symlink
+func checkArchive(r io.Reader, paths []string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	var symlinks []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+
+		names := []string{hdr.Name}
+		if hdr.Typeflag == tar.TypeLink {
+			names = append(names, hdr.Linkname)
+		}
+		for _, name := range names {
+			if !inArchivePaths(name, paths) || inArchivePaths(name, symlinks) {
+				return fmt.Errorf("%w: %s is outside the workspace's volumes", ErrInvalidBackup, name)
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			symlinks = append(symlinks, hdr.Name)
+		}
+	}
+
+	// Pass on the rest of the stream, such as the gzip trailer
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+	}
+
+	return nil
+}
+
+// inArchivePaths reports whether the archive entry name is one of the paths
+// or beneath one. Absolute names and those with a ".." element never are.
+func inArchivePaths(name string, paths []string) bool {
+	if path.IsAbs(name) || slices.Contains(strings.Split(name, "/"), "..") {
+		return false
+	}
+
+	name = path.Clean(name)
+	for _, p := range paths {
+		p = path.Clean(p)
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hetzner) runOnVolume(
+	ctx context.Context, server *hcloud.Server, privateKeyFile []byte, command string, stdin io.Reader, stdout io.Writer,
+) error {
+	if server.Status != hcloud.ServerStatusRunning {
+		return ErrServerNotRunning(server.Name)
+	}
+
+	sshClient, err := h.SSHClient(server, privateKeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to connect to server: %w", err)
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+
+	stderr := new(bytes.Buffer)
+	if err := ssh.Run(ctx, sshClient, command, stdin, stdout, stderr, nil); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuoteAll quotes each of words, separated by spaces
+func shellQuoteAll(words []string) string {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		quoted = append(quoted, shellQuote(w))
+	}
+	return strings.Join(quoted, " ")
+}
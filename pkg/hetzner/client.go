@@ -0,0 +1,158 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	hga "github.com/mrsimonemms/hetzner-golang-actions"
+)
+
+// CloudClient is the subset of the Hetzner Cloud API used by the provider.
+// Each field mirrors the equivalent field on hcloud.Client so it can be
+// replaced with a fake in tests
+type CloudClient struct {
+	Action         ActionWaiter
+	Datacenter     DatacenterClient
+	Firewall       FirewallClient
+	Image          ImageClient
+	Location       LocationClient
+	Network        NetworkClient
+	PlacementGroup PlacementGroupClient
+	PrimaryIP      PrimaryIPClient
+	Server         ServerClient
+	ServerType     ServerTypeClient
+	SSHKey         SSHKeyClient
+	Volume         VolumeClient
+
+	// SnapshotAction waits for snapshots, which take longer than other actions
+	SnapshotAction ActionWaiter
+}
+
+// ActionWaiter blocks until the given actions have completed
+type ActionWaiter interface {
+	Wait(ctx context.Context, action *hcloud.Action, nextActions ...*hcloud.Action) error
+}
+
+// waitForActions waits for a list of actions, which may be empty
+func waitForActions(ctx context.Context, waiter ActionWaiter, actions []*hcloud.Action) error {
+	if len(actions) == 0 {
+		return nil
+	}
+
+	return waiter.Wait(ctx, actions[0], actions[1:]...)
+}
+
+type DatacenterClient interface {
+	List(ctx context.Context, opts hcloud.DatacenterListOpts) ([]*hcloud.Datacenter, *hcloud.Response, error)
+}
+
+type FirewallClient interface {
+	Create(ctx context.Context, opts hcloud.FirewallCreateOpts) (hcloud.FirewallCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, firewall *hcloud.Firewall) (*hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Firewall, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.FirewallListOpts) ([]*hcloud.Firewall, *hcloud.Response, error)
+	SetRules(ctx context.Context, firewall *hcloud.Firewall, opts hcloud.FirewallSetRulesOpts) ([]*hcloud.Action, *hcloud.Response, error)
+}
+
+type ImageClient interface {
+	Delete(ctx context.Context, image *hcloud.Image) (*hcloud.Response, error)
+	GetByNameAndArchitecture(ctx context.Context, name string, architecture hcloud.Architecture) (*hcloud.Image, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.ImageListOpts) ([]*hcloud.Image, *hcloud.Response, error)
+}
+
+type LocationClient interface {
+	GetByName(ctx context.Context, name string) (*hcloud.Location, *hcloud.Response, error)
+}
+
+type NetworkClient interface {
+	Get(ctx context.Context, idOrName string) (*hcloud.Network, *hcloud.Response, error)
+}
+
+type PlacementGroupClient interface {
+	Create(ctx context.Context, opts hcloud.PlacementGroupCreateOpts) (hcloud.PlacementGroupCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, placementGroup *hcloud.PlacementGroup) (*hcloud.Response, error)
+	Get(ctx context.Context, idOrName string) (*hcloud.PlacementGroup, *hcloud.Response, error)
+}
+
+type PrimaryIPClient interface {
+	Create(ctx context.Context, opts hcloud.PrimaryIPCreateOpts) (*hcloud.PrimaryIPCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, primaryIP *hcloud.PrimaryIP) (*hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.PrimaryIPListOpts) ([]*hcloud.PrimaryIP, *hcloud.Response, error)
+}
+
+type ServerClient interface {
+	AttachToNetwork(
+		ctx context.Context,
+		server *hcloud.Server,
+		opts hcloud.ServerAttachToNetworkOpts,
+	) (*hcloud.Action, *hcloud.Response, error)
+	Create(ctx context.Context, opts hcloud.ServerCreateOpts) (hcloud.ServerCreateResult, *hcloud.Response, error)
+	CreateImage(
+		ctx context.Context,
+		server *hcloud.Server,
+		opts *hcloud.ServerCreateImageOpts,
+	) (hcloud.ServerCreateImageResult, *hcloud.Response, error)
+	DeleteWithResult(ctx context.Context, server *hcloud.Server) (*hcloud.ServerDeleteResult, *hcloud.Response, error)
+	GetByName(ctx context.Context, name string) (*hcloud.Server, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.ServerListOpts) ([]*hcloud.Server, *hcloud.Response, error)
+	Poweroff(ctx context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+	Poweron(ctx context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+	Shutdown(ctx context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+}
+
+type ServerTypeClient interface {
+	GetByName(ctx context.Context, name string) (*hcloud.ServerType, *hcloud.Response, error)
+}
+
+type SSHKeyClient interface {
+	Create(ctx context.Context, opts hcloud.SSHKeyCreateOpts) (*hcloud.SSHKey, *hcloud.Response, error)
+	Delete(ctx context.Context, sshKey *hcloud.SSHKey) (*hcloud.Response, error)
+	GetByFingerprint(ctx context.Context, fingerprint string) (*hcloud.SSHKey, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.SSHKeyListOpts) ([]*hcloud.SSHKey, *hcloud.Response, error)
+}
+
+type VolumeClient interface {
+	Attach(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
+	Create(ctx context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error)
+	Delete(ctx context.Context, volume *hcloud.Volume) (*hcloud.Response, error)
+	Detach(ctx context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error)
+	GetByID(ctx context.Context, id int64) (*hcloud.Volume, *hcloud.Response, error)
+	List(ctx context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error)
+	Resize(ctx context.Context, volume *hcloud.Volume, size int) (*hcloud.Action, *hcloud.Response, error)
+}
+
+// NewCloudClient wires the CloudClient to the hcloud-go library
+func NewCloudClient(client *hcloud.Client) *CloudClient {
+	return &CloudClient{
+		Action:         hga.NewWaiter(client),
+		Datacenter:     &client.Datacenter,
+		Firewall:       &client.Firewall,
+		Image:          &client.Image,
+		Location:       &client.Location,
+		Network:        &client.Network,
+		PlacementGroup: &client.PlacementGroup,
+		PrimaryIP:      &client.PrimaryIP,
+		Server:         &client.Server,
+		ServerType:     &client.ServerType,
+		SSHKey:         &client.SSHKey,
+		Volume:         &client.Volume,
+
+		SnapshotAction: hga.NewWaiter(client, hga.WithTimeout(snapshotTimeout)),
+	}
+}
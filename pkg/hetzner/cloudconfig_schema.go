@@ -0,0 +1,178 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"fmt"
+
+	"github.com/loft-sh/log"
+	"gopkg.in/yaml.v3"
+)
+
+// anyKind accepts a value of any type
+const anyKind yaml.Kind = 0
+
+// cloudConfigKeys are the common top-level keys cloud-init understands and the
+// type of value expected where there's only one that's valid. Other keys are
+// rejected unless CLOUD_INIT_ALLOW_UNKNOWN_KEYS is set, eg for a module added
+// in a newer cloud-init.
+var cloudConfigKeys = map[string]yaml.Kind{
+	"allow_public_ssh_keys":      yaml.ScalarNode,
+	"ansible":                    yaml.MappingNode,
+	"apk_repos":                  yaml.MappingNode,
+	"apt":                        yaml.MappingNode,
+	"apt_pipelining":             anyKind,
+	"apt_reboot_if_required":     yaml.ScalarNode,
+	"apt_update":                 yaml.ScalarNode,
+	"apt_upgrade":                yaml.ScalarNode,
+	"autoinstall":                yaml.MappingNode,
+	"bootcmd":                    yaml.SequenceNode,
+	"byobu_by_default":           yaml.ScalarNode,
+	"ca-certs":                   yaml.MappingNode,
+	"ca_certs":                   yaml.MappingNode,
+	"chef":                       yaml.MappingNode,
+	"chpasswd":                   yaml.MappingNode,
+	"cloud_config_modules":       yaml.SequenceNode,
+	"cloud_final_modules":        yaml.SequenceNode,
+	"cloud_init_modules":         yaml.SequenceNode,
+	"create_hostname_file":       yaml.ScalarNode,
+	"device_aliases":             yaml.MappingNode,
+	"disable_ec2_metadata":       yaml.ScalarNode,
+	"disable_root":               yaml.ScalarNode,
+	"disable_root_opts":          yaml.ScalarNode,
+	"disk_setup":                 yaml.MappingNode,
+	"drivers":                    yaml.MappingNode,
+	"fan":                        yaml.MappingNode,
+	"final_message":              yaml.ScalarNode,
+	"fqdn":                       yaml.ScalarNode,
+	"fs_setup":                   yaml.SequenceNode,
+	"groups":                     anyKind,
+	"growpart":                   yaml.MappingNode,
+	"hostname":                   yaml.ScalarNode,
+	"keyboard":                   yaml.MappingNode,
+	"landscape":                  yaml.MappingNode,
+	"locale":                     anyKind,
+	"locale_configfile":          yaml.ScalarNode,
+	"lxd":                        yaml.MappingNode,
+	"manage_etc_hosts":           anyKind,
+	"manage_resolv_conf":         yaml.ScalarNode,
+	"mcollective":                yaml.MappingNode,
+	"merge_how":                  anyKind,
+	"merge_type":                 anyKind,
+	"mount_default_fields":       yaml.SequenceNode,
+	"mounts":                     yaml.SequenceNode,
+	"no_ssh_fingerprints":        yaml.ScalarNode,
+	"ntp":                        yaml.MappingNode,
+	"output":                     yaml.MappingNode,
+	"package_reboot_if_required": yaml.ScalarNode,
+	"package_update":             yaml.ScalarNode,
+	"package_upgrade":            yaml.ScalarNode,
+	"packages":                   yaml.SequenceNode,
+	"password":                   yaml.ScalarNode,
+	"phone_home":                 yaml.MappingNode,
+	"power_state":                yaml.MappingNode,
+	"prefer_fqdn_over_hostname":  yaml.ScalarNode,
+	"preserve_hostname":          yaml.ScalarNode,
+	"puppet":                     yaml.MappingNode,
+	"random_seed":                yaml.MappingNode,
+	"reporting":                  yaml.MappingNode,
+	"resize_rootfs":              anyKind,
+	"resolv_conf":                yaml.MappingNode,
+	"rh_subscription":            yaml.MappingNode,
+	"rsyslog":                    anyKind,
+	"runcmd":                     yaml.SequenceNode,
+	"salt_minion":                yaml.MappingNode,
+	"snap":                       yaml.MappingNode,
+	"spacewalk":                  yaml.MappingNode,
+	"ssh":                        yaml.MappingNode,
+	"ssh_authorized_keys":        yaml.SequenceNode,
+	"ssh_deletekeys":             yaml.ScalarNode,
+	"ssh_fp_console_blacklist":   yaml.SequenceNode,
+	"ssh_genkeytypes":            yaml.SequenceNode,
+	"ssh_import_id":              yaml.SequenceNode,
+	"ssh_key_console_blacklist":  yaml.SequenceNode,
+	"ssh_keys":                   yaml.MappingNode,
+	"ssh_publish_hostkeys":       yaml.MappingNode,
+	"ssh_pwauth":                 yaml.ScalarNode,
+	"ssh_quiet_keygen":           yaml.ScalarNode,
+	"swap":                       yaml.MappingNode,
+	"system_info":                yaml.MappingNode,
+	"timezone":                   yaml.ScalarNode,
+	"ubuntu_advantage":           yaml.MappingNode,
+	"ubuntu_pro":                 yaml.MappingNode,
+	"updates":                    yaml.MappingNode,
+	"user":                       anyKind,
+	"users":                      anyKind,
+	"vendor_data":                yaml.MappingNode,
+	"wireguard":                  yaml.MappingNode,
+	"write_files":                yaml.SequenceNode,
+	"yum_repo_dir":               yaml.ScalarNode,
+	"yum_repos":                  yaml.MappingNode,
+	"zypper":                     yaml.MappingNode,
+}
+
+var kindNames = map[yaml.Kind]string{
+	yaml.MappingNode:  "a mapping",
+	yaml.ScalarNode:   "a single value",
+	yaml.SequenceNode: "a list",
+}
+
+// validateCloudConfig checks the rendered cloud-config is well-formed YAML
+// which only uses keys cloud-init knows about, with the right type of value.
+// If unknown keys are allowed, they're warned about once instead. The source
+// names where it came from in the error.
+func (h *Hetzner) validateCloudConfig(source, data string) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidCloudConfig, source, err)
+	}
+
+	if len(doc.Content) == 0 {
+		// Empty document
+		return nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%w: %s must be a YAML mapping", ErrInvalidCloudConfig, source)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+
+		kind, ok := cloudConfigKeys[key.Value]
+		if !ok {
+			if !h.allowUnknownKeys {
+				return fmt.Errorf("%w: %s line %d: unknown key %q", ErrInvalidCloudConfig, source, key.Line, key.Value)
+			}
+			if !h.warnedKeys[key.Value] {
+				log.Default.Warnf("%s line %d: unknown cloud-config key %q - check it isn't a typo", source, key.Line, key.Value)
+				h.warnedKeys[key.Value] = true
+			}
+			continue
+		}
+
+		if kind != anyKind && value.Kind != kind && value.Tag != "!!null" {
+			return fmt.Errorf("%w: %s line %d: %q must be %s", ErrInvalidCloudConfig, source, key.Line, key.Value, kindNames[kind])
+		}
+	}
+
+	return nil
+}
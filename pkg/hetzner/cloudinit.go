@@ -0,0 +1,275 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed cloud-config.yaml
+var cloudConfig embed.FS
+
+const (
+	cloudConfigHeader = "#cloud-config\n"
+
+	// maxUserDataSize is the most user-data Hetzner accepts
+	maxUserDataSize = 32 * 1024
+)
+
+// templateData is available to the cloud-config templates
+type templateData struct {
+	PublicKey    string
+	VolumeID     string
+	Username     string
+	Runtime      runtimeSetup
+	Volume       volumeMount
+	ExtraVolumes []extraVolumeMount
+	Options      *options.Options
+}
+
+// generateUserData renders the cloud-config. If there are any scripts or
+// #include URLs, it's sent with them as a MIME multipart document.
+func (h *Hetzner) generateUserData(
+	publicKey string,
+	volumeID int64,
+	extraVolumes []*hcloud.Volume,
+	image *hcloud.Image,
+) (string, error) {
+	userData, err := h.buildUserData(publicKey, volumeID, extraVolumes, image)
+	if err != nil {
+		return "", err
+	}
+
+	if len(userData) > maxUserDataSize {
+		return "", fmt.Errorf("%w: %d bytes, the limit is %d", ErrUserDataTooLarge, len(userData), maxUserDataSize)
+	}
+
+	return userData, nil
+}
+
+// checkUserData generates the user-data to check it's valid and isn't too
+// large. The volume IDs aren't known yet, so the longest possible one stands
+// in for them.
+func (h *Hetzner) checkUserData(publicKey string, image *hcloud.Image) error {
+	placeholders := make([]*hcloud.Volume, len(h.extraVolumes))
+	for i := range placeholders {
+		placeholders[i] = &hcloud.Volume{ID: math.MaxInt64}
+	}
+
+	_, err := h.generateUserData(publicKey, math.MaxInt64, placeholders, image)
+	return err
+}
+
+func (h *Hetzner) buildUserData(publicKey string, volumeID int64, extraVolumes []*hcloud.Volume, image *hcloud.Image) (string, error) {
+	config, err := h.generateCloudConfig(publicKey, volumeID, extraVolumes, image)
+	if err != nil || (len(h.userDataScripts) == 0 && len(h.userDataIncludes) == 0) {
+		return config, err
+	}
+
+	parts := []userDataPart{{contentType: "text/cloud-config", filename: "cloud-config.yaml", content: config}}
+	for i, path := range h.userDataScripts {
+		script, err := readUserDataScript(path)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, userDataPart{
+			contentType: "text/x-shellscript",
+			filename:    fmt.Sprintf("script-%d.sh", i+1),
+			content:     script,
+		})
+	}
+	if len(h.userDataIncludes) > 0 {
+		parts = append(parts, userDataPart{
+			contentType: "text/x-include-url",
+			filename:    "includes.txt",
+			content:     "#include\n" + strings.Join(h.userDataIncludes, "\n") + "\n",
+		})
+	}
+
+	return multipartUserData(parts)
+}
+
+// readUserDataScript reads a script to run on first boot, which cloud-init
+// only runs if it starts with a shebang
+func readUserDataScript(path string) (string, error) {
+	script, err := os.ReadFile(path) //nolint:gosec // the path is chosen by the user
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidUserDataScript, err)
+	}
+	if !bytes.HasPrefix(script, []byte("#!")) {
+		return "", fmt.Errorf("%w: %s must start with a shebang, eg #!/bin/bash", ErrInvalidUserDataScript, path)
+	}
+
+	return string(script), nil
+}
+
+// generateCloudConfig renders the cloud-config, merging in any extra
+// configuration supplied by the user
+func (h *Hetzner) generateCloudConfig(
+	publicKey string,
+	volumeID int64,
+	extraVolumes []*hcloud.Volume,
+	image *hcloud.Image,
+) (string, error) {
+	data := templateData{
+		PublicKey: strings.TrimSuffix(publicKey, "\n"),
+		Username:  SSHUsername,
+		Runtime:   h.runtimeSetup(image),
+		Volume:    h.volume,
+		Options:   h.options,
+	}
+	if h.persistentVolume {
+		data.VolumeID = strconv.FormatInt(volumeID, 10)
+	}
+	for i, volume := range extraVolumes {
+		data.ExtraVolumes = append(data.ExtraVolumes, extraVolumeMount{
+			ID:   strconv.FormatInt(volume.ID, 10),
+			Path: h.extraVolumes[i].Path,
+		})
+	}
+
+	t, err := template.New("cloud-config.yaml").ParseFS(cloudConfig, "cloud-config.yaml")
+	if err != nil {
+		return "", err
+	}
+
+	userData, err := renderTemplate(t, data)
+	if err != nil {
+		return "", err
+	}
+	if err := h.validateCloudConfig("cloud-config.yaml", userData); err != nil || h.cloudInitExtra == "" {
+		return userData, err
+	}
+
+	extraTemplate, err := options.FileOrInline(h.cloudInitExtra)
+	if err != nil {
+		return "", fmt.Errorf("invalid CLOUD_INIT_EXTRA: %w", err)
+	}
+
+	t, err = template.New("CLOUD_INIT_EXTRA").Parse(extraTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid CLOUD_INIT_EXTRA: %w", err)
+	}
+
+	extraData, err := renderTemplate(t, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid CLOUD_INIT_EXTRA: %w", err)
+	}
+	if err := h.validateCloudConfig("CLOUD_INIT_EXTRA", extraData); err != nil {
+		return "", err
+	}
+
+	var base, extra map[string]any
+	if err := yaml.Unmarshal([]byte(userData), &base); err != nil {
+		return "", err
+	}
+	if err := yaml.Unmarshal([]byte(extraData), &extra); err != nil {
+		return "", err
+	}
+
+	merged, err := yaml.Marshal(mergeCloudConfig(base, extra))
+	if err != nil {
+		return "", err
+	}
+
+	return cloudConfigHeader + string(merged), nil
+}
+
+type userDataPart struct {
+	contentType string
+	filename    string
+	content     string
+}
+
+// multipartUserData builds a MIME multipart document that cloud-init splits
+// back into its parts, handling each by its content type
+func multipartUserData(parts []userDataPart) (string, error) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", mime.FormatMediaType(part.contentType, map[string]string{"charset": "utf-8"}))
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": part.filename}))
+
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := pw.Write([]byte(part.content)); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	contentType := mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})
+
+	return fmt.Sprintf("Content-Type: %s\nMIME-Version: 1.0\n\n%s", contentType, body.String()), nil
+}
+
+func renderTemplate(t *template.Template, data templateData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// mergeCloudConfig deep-merges the extra cloud-config into the base. Mappings
+// are merged key by key, lists such as packages and runcmd are appended to and
+// anything else is replaced.
+func mergeCloudConfig(base, extra map[string]any) map[string]any {
+	if base == nil {
+		base = map[string]any{}
+	}
+
+	for k, v := range extra {
+		switch v := v.(type) {
+		case map[string]any:
+			if b, ok := base[k].(map[string]any); ok {
+				base[k] = mergeCloudConfig(b, v)
+				continue
+			}
+		case []any:
+			if b, ok := base[k].([]any); ok {
+				base[k] = append(b, v...)
+				continue
+			}
+		}
+		base[k] = v
+	}
+
+	return base
+}
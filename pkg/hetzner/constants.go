@@ -16,9 +16,17 @@
 
 package hetzner
 
+import "time"
+
 const (
-	labelMachineID           = "machineId"
-	maxServerConnectAttempts = 60
-	SSHUsername              = "devpod"
-	SSHPort                  = 22
+	cloudInitLogLines       = 50
+	defaultProvisionTimeout = 10 * time.Minute
+	labelMachineID          = "machineId"
+	labelVolume             = "volume"
+	maxShutdownAttempts     = 60
+	provisionInitialBackoff = time.Second
+	provisionMaxBackoff     = 30 * time.Second
+	snapshotTimeout         = 30 * time.Minute
+	SSHUsername             = "devpod"
+	SSHPort                 = 22
 )
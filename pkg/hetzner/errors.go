@@ -22,14 +22,46 @@ import (
 )
 
 var (
-	ErrBadSSHKey            = errors.New("bad ssh key")
-	ErrMultipleServersFound = func(name string) error {
+	ErrBadSSHKey             = errors.New("bad ssh key")
+	ErrCloudInitFailed       = errors.New("cloud-init failed")
+	ErrInvalidBackup         = errors.New("invalid backup")
+	ErrInvalidCloudConfig    = errors.New("invalid cloud-config")
+	ErrInvalidUserDataScript = errors.New("invalid USER_DATA_SCRIPTS")
+	ErrMultipleServersFound  = func(name string) error {
 		return fmt.Errorf("multiple server with name %s found", name)
 	}
-	ErrMultipleVolumesFound = func(name string) error {
-		return fmt.Errorf("multiple volumes with name %s found", name)
+	ErrMultipleVolumesFound = func(machineID, role string) error {
+		return fmt.Errorf("multiple %s volumes found for machine %s", role, machineID)
+	}
+	ErrNoDatacenter = func(location string) error {
+		return fmt.Errorf("no datacenter found in location %s", location)
+	}
+	ErrNoServerAddress  = errors.New("server has no address to connect to")
+	ErrNoVolumes        = errors.New("workspace has no volumes to back up - set PERSISTENT_VOLUME or EXTRA_VOLUMES")
+	ErrProvisionTimeout = errors.New("timed out waiting for server to provision")
+	ErrServerDeleting   = func(name string) error {
+		return fmt.Errorf("server %s is being deleted, try again once it has gone", name)
+	}
+	ErrServerNotRunning = func(name string) error {
+		return fmt.Errorf("server %s isn't running, start the workspace first", name)
 	}
 	ErrUnknownDiskImage = errors.New("unknown disk image")
+	ErrUnknownFirewall  = errors.New("unknown firewall")
 	ErrUnknownMachineID = errors.New("unknown machine id")
+	ErrUnknownNetwork   = errors.New("unknown network")
 	ErrUnknownRegion    = errors.New("unknown region")
+	ErrUserDataTooLarge = errors.New("user-data is too large")
+	ErrVolumeAttached   = func(name string, serverID int64) error {
+		return fmt.Errorf("volume %s is attached to another server: %d", name, serverID)
+	}
+	ErrVolumeFilesystem = func(name, format, filesystem string) error {
+		return fmt.Errorf("volume %s is formatted as %s and can't be mounted as %s", name, format, filesystem)
+	}
+	ErrVolumeNotOnServer = func(name, serverName string) error {
+		return fmt.Errorf("volume %s can't be added to the existing server %s - stop the workspace with STOP_MODE=delete "+
+			"so the server is created again with it", name, serverName)
+	}
+	ErrVolumeShrink = func(name string, size, diskSize int) error {
+		return fmt.Errorf("volume %s is %dGB and can't be shrunk to %dGB - volumes can only grow", name, size, diskSize)
+	}
 )
@@ -0,0 +1,718 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// fakeCloud is an in-memory implementation of the CloudClient interfaces
+type fakeCloud struct {
+	nextID int64
+
+	datacenters     []*hcloud.Datacenter
+	firewalls       []*hcloud.Firewall
+	images          []*hcloud.Image
+	locations       []*hcloud.Location
+	networks        []*hcloud.Network
+	placementGroups []*hcloud.PlacementGroup
+	primaryIPs      []*hcloud.PrimaryIP
+	servers         []*hcloud.Server
+	serverTypes     []*hcloud.ServerType
+	sshKeys         []*hcloud.SSHKey
+	volumes         []*hcloud.Volume
+
+	// waitErr is returned by the action waiter when set. If failCommand is
+	// also set, it is only returned when waiting for that command.
+	waitErr     error
+	failCommand string
+}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{
+		images: []*hcloud.Image{
+			{ID: 1, Name: "docker-ce", Type: hcloud.ImageTypeApp, OSFlavor: "ubuntu", Architecture: hcloud.ArchitectureX86},
+			{ID: 2, Name: "docker-ce", Type: hcloud.ImageTypeApp, OSFlavor: "ubuntu", Architecture: hcloud.ArchitectureARM},
+			{ID: 3, Name: "debian-12", Type: hcloud.ImageTypeSystem, OSFlavor: "debian", Architecture: hcloud.ArchitectureX86},
+		},
+		locations: []*hcloud.Location{
+			{ID: 1, Name: "nbg1"},
+		},
+		datacenters: []*hcloud.Datacenter{
+			{ID: 1, Name: "nbg1-dc3", Location: &hcloud.Location{ID: 1, Name: "nbg1"}},
+		},
+		networks: []*hcloud.Network{
+			{ID: 1, Name: "devpod", IPRange: &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(16, 32)}},
+		},
+		serverTypes: []*hcloud.ServerType{
+			{ID: 1, Name: "cx22", Architecture: hcloud.ArchitectureX86},
+			{ID: 2, Name: "cax11", Architecture: hcloud.ArchitectureARM},
+		},
+		nextID: 100,
+	}
+}
+
+func (f *fakeCloud) client() *CloudClient {
+	return &CloudClient{
+		Action:         fakeActions{f},
+		Datacenter:     fakeDatacenters{f},
+		Firewall:       fakeFirewalls{f},
+		Image:          fakeImages{f},
+		Location:       fakeLocations{f},
+		Network:        fakeNetworks{f},
+		PlacementGroup: fakePlacementGroups{f},
+		PrimaryIP:      fakePrimaryIPs{f},
+		Server:         fakeServers{f},
+		ServerType:     fakeServerTypes{f},
+		SSHKey:         fakeSSHKeys{f},
+		Volume:         fakeVolumes{f},
+
+		SnapshotAction: fakeActions{f},
+	}
+}
+
+func (f *fakeCloud) id() int64 {
+	f.nextID++
+	return f.nextID
+}
+
+func (f *fakeCloud) action(command string) *hcloud.Action {
+	return &hcloud.Action{
+		ID:       f.id(),
+		Command:  command,
+		Status:   hcloud.ActionStatusSuccess,
+		Progress: 100,
+	}
+}
+
+// matchesLabels implements the equality subset of the label selector syntax
+func matchesLabels(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, term := range strings.Split(selector, ",") {
+		k, v, _ := strings.Cut(term, "=")
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type fakeActions struct{ f *fakeCloud }
+
+func (a fakeActions) Wait(_ context.Context, action *hcloud.Action, _ ...*hcloud.Action) error {
+	if a.f.failCommand != "" && action.Command != a.f.failCommand {
+		return nil
+	}
+	return a.f.waitErr
+}
+
+type fakeDatacenters struct{ f *fakeCloud }
+
+func (d fakeDatacenters) List(_ context.Context, _ hcloud.DatacenterListOpts) ([]*hcloud.Datacenter, *hcloud.Response, error) {
+	return d.f.datacenters, nil, nil
+}
+
+type fakeFirewalls struct{ f *fakeCloud }
+
+func (w fakeFirewalls) Create(_ context.Context, opts hcloud.FirewallCreateOpts) (hcloud.FirewallCreateResult, *hcloud.Response, error) {
+	firewall := &hcloud.Firewall{
+		ID:     w.f.id(),
+		Name:   opts.Name,
+		Labels: opts.Labels,
+		Rules:  opts.Rules,
+	}
+	w.f.firewalls = append(w.f.firewalls, firewall)
+
+	return hcloud.FirewallCreateResult{Firewall: firewall}, nil, nil
+}
+
+func (w fakeFirewalls) Delete(_ context.Context, firewall *hcloud.Firewall) (*hcloud.Response, error) {
+	for i, fw := range w.f.firewalls {
+		if fw.ID != firewall.ID {
+			continue
+		}
+		if len(fw.AppliedTo) > 0 {
+			return nil, fmt.Errorf("firewall is still in use (resource_in_use)")
+		}
+		w.f.firewalls = append(w.f.firewalls[:i], w.f.firewalls[i+1:]...)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("firewall not found (not_found)")
+}
+
+func (w fakeFirewalls) GetByName(_ context.Context, name string) (*hcloud.Firewall, *hcloud.Response, error) {
+	for _, fw := range w.f.firewalls {
+		if fw.Name == name {
+			return fw, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (w fakeFirewalls) List(_ context.Context, opts hcloud.FirewallListOpts) ([]*hcloud.Firewall, *hcloud.Response, error) {
+	firewalls := make([]*hcloud.Firewall, 0)
+	for _, fw := range w.f.firewalls {
+		if matchesLabels(fw.Labels, opts.LabelSelector) {
+			firewalls = append(firewalls, fw)
+		}
+	}
+	return firewalls, nil, nil
+}
+
+func (w fakeFirewalls) SetRules(
+	_ context.Context,
+	firewall *hcloud.Firewall,
+	opts hcloud.FirewallSetRulesOpts,
+) ([]*hcloud.Action, *hcloud.Response, error) {
+	for _, fw := range w.f.firewalls {
+		if fw.ID == firewall.ID {
+			fw.Rules = opts.Rules
+			return []*hcloud.Action{w.f.action("set_firewall_rules")}, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("firewall not found (not_found)")
+}
+
+type fakeImages struct{ f *fakeCloud }
+
+func (i fakeImages) GetByNameAndArchitecture(
+	_ context.Context,
+	name string,
+	architecture hcloud.Architecture,
+) (*hcloud.Image, *hcloud.Response, error) {
+	for _, img := range i.f.images {
+		if img.Name == name && img.Architecture == architecture {
+			return img, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (i fakeImages) Delete(_ context.Context, image *hcloud.Image) (*hcloud.Response, error) {
+	for n, img := range i.f.images {
+		if img.ID == image.ID {
+			i.f.images = append(i.f.images[:n], i.f.images[n+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("image not found (not_found)")
+}
+
+func (i fakeImages) List(_ context.Context, opts hcloud.ImageListOpts) ([]*hcloud.Image, *hcloud.Response, error) {
+	images := make([]*hcloud.Image, 0)
+	for _, img := range i.f.images {
+		if len(opts.Type) > 0 && !slices.Contains(opts.Type, img.Type) {
+			continue
+		}
+		if matchesLabels(img.Labels, opts.LabelSelector) {
+			images = append(images, img)
+		}
+	}
+	return images, nil, nil
+}
+
+type fakeLocations struct{ f *fakeCloud }
+
+func (l fakeLocations) GetByName(_ context.Context, name string) (*hcloud.Location, *hcloud.Response, error) {
+	for _, loc := range l.f.locations {
+		if loc.Name == name {
+			return loc, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+type fakeNetworks struct{ f *fakeCloud }
+
+func (n fakeNetworks) Get(_ context.Context, idOrName string) (*hcloud.Network, *hcloud.Response, error) {
+	for _, network := range n.f.networks {
+		if network.Name == idOrName || strconv.FormatInt(network.ID, 10) == idOrName {
+			return network, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+type fakePlacementGroups struct{ f *fakeCloud }
+
+func (p fakePlacementGroups) Create(
+	_ context.Context,
+	opts hcloud.PlacementGroupCreateOpts,
+) (hcloud.PlacementGroupCreateResult, *hcloud.Response, error) {
+	placementGroup := &hcloud.PlacementGroup{
+		ID:     p.f.id(),
+		Name:   opts.Name,
+		Labels: opts.Labels,
+		Type:   opts.Type,
+	}
+	p.f.placementGroups = append(p.f.placementGroups, placementGroup)
+
+	return hcloud.PlacementGroupCreateResult{PlacementGroup: placementGroup}, nil, nil
+}
+
+func (p fakePlacementGroups) Delete(_ context.Context, placementGroup *hcloud.PlacementGroup) (*hcloud.Response, error) {
+	for i, pg := range p.f.placementGroups {
+		if pg.ID == placementGroup.ID {
+			p.f.placementGroups = append(p.f.placementGroups[:i], p.f.placementGroups[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("placement group not found (not_found)")
+}
+
+func (p fakePlacementGroups) Get(_ context.Context, idOrName string) (*hcloud.PlacementGroup, *hcloud.Response, error) {
+	for _, pg := range p.f.placementGroups {
+		if pg.Name == idOrName || strconv.FormatInt(pg.ID, 10) == idOrName {
+			return pg, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+type fakePrimaryIPs struct{ f *fakeCloud }
+
+func (p fakePrimaryIPs) Create(
+	_ context.Context,
+	opts hcloud.PrimaryIPCreateOpts,
+) (*hcloud.PrimaryIPCreateResult, *hcloud.Response, error) {
+	id := p.f.id()
+	ip := net.IPv4(203, 0, 113, byte(id))
+	if opts.Type == hcloud.PrimaryIPTypeIPv6 {
+		ip = net.ParseIP(fmt.Sprintf("2001:db8:%x::", id))
+	}
+
+	primaryIP := &hcloud.PrimaryIP{
+		ID:           id,
+		IP:           ip,
+		Name:         opts.Name,
+		Type:         opts.Type,
+		Labels:       opts.Labels,
+		AssigneeType: opts.AssigneeType,
+		AutoDelete:   opts.AutoDelete != nil && *opts.AutoDelete,
+	}
+	p.f.primaryIPs = append(p.f.primaryIPs, primaryIP)
+
+	return &hcloud.PrimaryIPCreateResult{PrimaryIP: primaryIP}, nil, nil
+}
+
+func (p fakePrimaryIPs) Delete(_ context.Context, primaryIP *hcloud.PrimaryIP) (*hcloud.Response, error) {
+	for i, ip := range p.f.primaryIPs {
+		if ip.ID != primaryIP.ID {
+			continue
+		}
+		if ip.AssigneeID != 0 {
+			return nil, fmt.Errorf("primary ip is assigned (must_be_unassigned)")
+		}
+		p.f.primaryIPs = append(p.f.primaryIPs[:i], p.f.primaryIPs[i+1:]...)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("primary ip not found (not_found)")
+}
+
+func (p fakePrimaryIPs) List(_ context.Context, opts hcloud.PrimaryIPListOpts) ([]*hcloud.PrimaryIP, *hcloud.Response, error) {
+	primaryIPs := make([]*hcloud.PrimaryIP, 0)
+	for _, ip := range p.f.primaryIPs {
+		if matchesLabels(ip.Labels, opts.LabelSelector) {
+			primaryIPs = append(primaryIPs, ip)
+		}
+	}
+	return primaryIPs, nil, nil
+}
+
+// assign assigns a Primary IP to the server, as happens when a
+// server is created with it
+func (p fakePrimaryIPs) assign(primaryIP *hcloud.PrimaryIP, server *hcloud.Server) error {
+	for _, ip := range p.f.primaryIPs {
+		if ip.ID != primaryIP.ID {
+			continue
+		}
+		if ip.AssigneeID != 0 {
+			return fmt.Errorf("primary ip is already assigned (primary_ip_assigned)")
+		}
+		ip.AssigneeID = server.ID
+		return nil
+	}
+	return fmt.Errorf("primary ip not found (not_found)")
+}
+
+type fakeServerTypes struct{ f *fakeCloud }
+
+func (s fakeServerTypes) GetByName(_ context.Context, name string) (*hcloud.ServerType, *hcloud.Response, error) {
+	for _, t := range s.f.serverTypes {
+		if t.Name == name {
+			return t, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+type fakeServers struct{ f *fakeCloud }
+
+func (s fakeServers) Create(_ context.Context, opts hcloud.ServerCreateOpts) (hcloud.ServerCreateResult, *hcloud.Response, error) {
+	if server, _, _ := s.GetByName(context.Background(), opts.Name); server != nil {
+		return hcloud.ServerCreateResult{}, nil, fmt.Errorf("server name is already used (uniqueness_error)")
+	}
+
+	server := &hcloud.Server{
+		ID:         s.f.id(),
+		Name:       opts.Name,
+		Status:     hcloud.ServerStatusRunning,
+		ServerType: opts.ServerType,
+		Image:      opts.Image,
+		Labels:     opts.Labels,
+		PublicNet: hcloud.ServerPublicNet{
+			IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP("127.0.0.1")},
+		},
+	}
+	if opts.PublicNet != nil {
+		if !opts.PublicNet.EnableIPv4 {
+			server.PublicNet.IPv4 = hcloud.ServerPublicNetIPv4{}
+		}
+		if ip := opts.PublicNet.IPv4; ip != nil {
+			if err := (fakePrimaryIPs{s.f}).assign(ip, server); err != nil {
+				return hcloud.ServerCreateResult{}, nil, err
+			}
+			server.PublicNet.IPv4 = hcloud.ServerPublicNetIPv4{ID: ip.ID, IP: ip.IP}
+		}
+		if ip := opts.PublicNet.IPv6; ip != nil {
+			if err := (fakePrimaryIPs{s.f}).assign(ip, server); err != nil {
+				return hcloud.ServerCreateResult{}, nil, err
+			}
+			server.PublicNet.IPv6 = hcloud.ServerPublicNetIPv6{ID: ip.ID, IP: ip.IP}
+		}
+	}
+
+	for i, network := range opts.Networks {
+		server.PrivateNet = append(server.PrivateNet, hcloud.ServerPrivateNet{
+			Network: network,
+			IP:      net.IPv4(10, 0, 0, byte(2+i)),
+		})
+	}
+
+	nextActions := []*hcloud.Action{s.f.action("start_server")}
+	if opts.StartAfterCreate != nil && !*opts.StartAfterCreate {
+		server.Status = hcloud.ServerStatusOff
+		nextActions = nil
+	}
+
+	for _, v := range opts.Volumes {
+		for _, vol := range s.f.volumes {
+			if vol.ID == v.ID {
+				vol.Server = server
+				server.Volumes = append(server.Volumes, vol)
+			}
+		}
+	}
+
+	if pg := opts.PlacementGroup; pg != nil {
+		server.PlacementGroup = pg
+		pg.Servers = append(pg.Servers, server.ID)
+	}
+
+	for _, f := range opts.Firewalls {
+		for _, fw := range s.f.firewalls {
+			if fw.ID == f.Firewall.ID {
+				fw.AppliedTo = append(fw.AppliedTo, hcloud.FirewallResource{
+					Type:   hcloud.FirewallResourceTypeServer,
+					Server: &hcloud.FirewallResourceServer{ID: server.ID},
+				})
+			}
+		}
+	}
+
+	s.f.servers = append(s.f.servers, server)
+
+	return hcloud.ServerCreateResult{
+		Server:      server,
+		Action:      s.f.action("create_server"),
+		NextActions: nextActions,
+	}, nil, nil
+}
+
+func (s fakeServers) AttachToNetwork(
+	_ context.Context,
+	server *hcloud.Server,
+	opts hcloud.ServerAttachToNetworkOpts,
+) (*hcloud.Action, *hcloud.Response, error) {
+	for _, srv := range s.f.servers {
+		if srv.ID != server.ID {
+			continue
+		}
+		for _, p := range srv.PrivateNet {
+			if p.Network.ID == opts.Network.ID {
+				return nil, nil, fmt.Errorf("server is already attached to network (server_already_attached)")
+			}
+		}
+		srv.PrivateNet = append(srv.PrivateNet, hcloud.ServerPrivateNet{Network: opts.Network, IP: opts.IP})
+		return s.f.action("attach_to_network"), nil, nil
+	}
+	return nil, nil, fmt.Errorf("server not found (not_found)")
+}
+
+func (s fakeServers) CreateImage(
+	_ context.Context,
+	server *hcloud.Server,
+	opts *hcloud.ServerCreateImageOpts,
+) (hcloud.ServerCreateImageResult, *hcloud.Response, error) {
+	image := &hcloud.Image{
+		ID:           s.f.id(),
+		Type:         opts.Type,
+		Status:       hcloud.ImageStatusAvailable,
+		Architecture: server.ServerType.Architecture,
+		Labels:       opts.Labels,
+		Created:      time.Now(),
+		CreatedFrom:  server,
+	}
+	s.f.images = append(s.f.images, image)
+
+	return hcloud.ServerCreateImageResult{
+		Image:  image,
+		Action: s.f.action("create_image"),
+	}, nil, nil
+}
+
+func (s fakeServers) DeleteWithResult(_ context.Context, server *hcloud.Server) (*hcloud.ServerDeleteResult, *hcloud.Response, error) {
+	for i, srv := range s.f.servers {
+		if srv.ID != server.ID {
+			continue
+		}
+
+		// Deleting a server detaches its volumes
+		for _, vol := range s.f.volumes {
+			if vol.Server != nil && vol.Server.ID == srv.ID {
+				vol.Server = nil
+			}
+		}
+
+		// ...leaves its placement group...
+		if pg := srv.PlacementGroup; pg != nil {
+			pg.Servers = slices.DeleteFunc(pg.Servers, func(id int64) bool { return id == srv.ID })
+		}
+
+		// ...unassigns its primary IPs...
+		for _, ip := range s.f.primaryIPs {
+			if ip.AssigneeID == srv.ID {
+				ip.AssigneeID = 0
+			}
+		}
+
+		// ...and removes it from its firewalls
+		for _, fw := range s.f.firewalls {
+			fw.AppliedTo = slices.DeleteFunc(fw.AppliedTo, func(r hcloud.FirewallResource) bool {
+				return r.Server != nil && r.Server.ID == srv.ID
+			})
+		}
+
+		s.f.servers = append(s.f.servers[:i], s.f.servers[i+1:]...)
+
+		return &hcloud.ServerDeleteResult{Action: s.f.action("delete_server")}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("server not found (not_found)")
+}
+
+func (s fakeServers) GetByName(_ context.Context, name string) (*hcloud.Server, *hcloud.Response, error) {
+	for _, srv := range s.f.servers {
+		if srv.Name == name {
+			return srv, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (s fakeServers) List(_ context.Context, opts hcloud.ServerListOpts) ([]*hcloud.Server, *hcloud.Response, error) {
+	servers := make([]*hcloud.Server, 0)
+	for _, srv := range s.f.servers {
+		if (opts.Name == "" || srv.Name == opts.Name) && matchesLabels(srv.Labels, opts.LabelSelector) {
+			servers = append(servers, srv)
+		}
+	}
+	return servers, nil, nil
+}
+
+func (s fakeServers) setStatus(
+	server *hcloud.Server,
+	status hcloud.ServerStatus,
+	command string,
+) (*hcloud.Action, *hcloud.Response, error) {
+	for _, srv := range s.f.servers {
+		if srv.ID == server.ID {
+			srv.Status = status
+			return s.f.action(command), nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("server not found (not_found)")
+}
+
+func (s fakeServers) Poweroff(_ context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	return s.setStatus(server, hcloud.ServerStatusOff, "stop_server")
+}
+
+func (s fakeServers) Poweron(_ context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	return s.setStatus(server, hcloud.ServerStatusRunning, "start_server")
+}
+
+func (s fakeServers) Shutdown(_ context.Context, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	return s.setStatus(server, hcloud.ServerStatusOff, "shutdown_server")
+}
+
+type fakeSSHKeys struct{ f *fakeCloud }
+
+func (k fakeSSHKeys) Create(_ context.Context, opts hcloud.SSHKeyCreateOpts) (*hcloud.SSHKey, *hcloud.Response, error) {
+	fingerprint, err := generateSSHKeyFingerprint(opts.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := &hcloud.SSHKey{
+		ID:          k.f.id(),
+		Name:        opts.Name,
+		Fingerprint: fingerprint,
+		PublicKey:   opts.PublicKey,
+		Labels:      opts.Labels,
+	}
+	k.f.sshKeys = append(k.f.sshKeys, key)
+
+	return key, nil, nil
+}
+
+func (k fakeSSHKeys) Delete(_ context.Context, sshKey *hcloud.SSHKey) (*hcloud.Response, error) {
+	for i, key := range k.f.sshKeys {
+		if key.ID == sshKey.ID {
+			k.f.sshKeys = append(k.f.sshKeys[:i], k.f.sshKeys[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("ssh key not found (not_found)")
+}
+
+func (k fakeSSHKeys) GetByFingerprint(_ context.Context, fingerprint string) (*hcloud.SSHKey, *hcloud.Response, error) {
+	for _, key := range k.f.sshKeys {
+		if key.Fingerprint == fingerprint {
+			return key, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (k fakeSSHKeys) List(_ context.Context, opts hcloud.SSHKeyListOpts) ([]*hcloud.SSHKey, *hcloud.Response, error) {
+	keys := make([]*hcloud.SSHKey, 0)
+	for _, key := range k.f.sshKeys {
+		if matchesLabels(key.Labels, opts.LabelSelector) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil, nil
+}
+
+type fakeVolumes struct{ f *fakeCloud }
+
+func (v fakeVolumes) Attach(_ context.Context, volume *hcloud.Volume, server *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	for _, vol := range v.f.volumes {
+		if vol.ID != volume.ID {
+			continue
+		}
+		if vol.Server != nil {
+			return nil, nil, fmt.Errorf("volume is already attached (locked)")
+		}
+		vol.Server = server
+		return v.f.action("attach_volume"), nil, nil
+	}
+	return nil, nil, fmt.Errorf("volume not found (not_found)")
+}
+
+func (v fakeVolumes) Create(_ context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	volume := &hcloud.Volume{
+		ID:       v.f.id(),
+		Name:     opts.Name,
+		Size:     opts.Size,
+		Format:   opts.Format,
+		Location: opts.Location,
+		Labels:   opts.Labels,
+	}
+	v.f.volumes = append(v.f.volumes, volume)
+
+	return hcloud.VolumeCreateResult{
+		Volume: volume,
+		Action: v.f.action("create_volume"),
+	}, nil, nil
+}
+
+func (v fakeVolumes) Delete(_ context.Context, volume *hcloud.Volume) (*hcloud.Response, error) {
+	for i, vol := range v.f.volumes {
+		if vol.ID != volume.ID {
+			continue
+		}
+		if vol.Server != nil {
+			return nil, fmt.Errorf("volume is attached (locked)")
+		}
+		v.f.volumes = append(v.f.volumes[:i], v.f.volumes[i+1:]...)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("volume not found (not_found)")
+}
+
+func (v fakeVolumes) Detach(_ context.Context, volume *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	for _, vol := range v.f.volumes {
+		if vol.ID == volume.ID {
+			vol.Server = nil
+		}
+	}
+	return v.f.action("detach_volume"), nil, nil
+}
+
+func (v fakeVolumes) GetByID(_ context.Context, id int64) (*hcloud.Volume, *hcloud.Response, error) {
+	for _, vol := range v.f.volumes {
+		if vol.ID == id {
+			return vol, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (v fakeVolumes) Resize(_ context.Context, volume *hcloud.Volume, size int) (*hcloud.Action, *hcloud.Response, error) {
+	for _, vol := range v.f.volumes {
+		if vol.ID != volume.ID {
+			continue
+		}
+		if size <= vol.Size {
+			return nil, nil, fmt.Errorf("volume can only grow (invalid_input)")
+		}
+		vol.Size = size
+		return v.f.action("resize_volume"), nil, nil
+	}
+	return nil, nil, fmt.Errorf("volume not found (not_found)")
+}
+
+func (v fakeVolumes) List(_ context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, *hcloud.Response, error) {
+	volumes := make([]*hcloud.Volume, 0)
+	for _, vol := range v.f.volumes {
+		if (opts.Name == "" || vol.Name == opts.Name) && matchesLabels(vol.Labels, opts.LabelSelector) {
+			volumes = append(volumes, vol)
+		}
+	}
+	return volumes, nil, nil
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+)
+
+// firewall is the configuration of the firewall managed for each workspace
+type firewall struct {
+	sshSources []net.IPNet
+	rules      []options.FirewallRule
+}
+
+// firewallRules builds the inbound rules - SSH from the configured sources
+// plus any extra rules
+func (h *Hetzner) firewallRules() []hcloud.FirewallRule {
+	rules := []hcloud.FirewallRule{
+		{
+			Direction:   hcloud.FirewallRuleDirectionIn,
+			Protocol:    hcloud.FirewallRuleProtocolTCP,
+			Port:        hcloud.Ptr(strconv.Itoa(h.sshPort)),
+			SourceIPs:   h.firewall.sshSources,
+			Description: hcloud.Ptr("SSH"),
+		},
+	}
+
+	for _, r := range h.firewall.rules {
+		rule := hcloud.FirewallRule{
+			Direction: hcloud.FirewallRuleDirectionIn,
+			Protocol:  hcloud.FirewallRuleProtocol(r.Protocol),
+			SourceIPs: r.Sources,
+		}
+		if r.Port != "" {
+			rule.Port = hcloud.Ptr(r.Port)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// upsertFirewall creates the workspace's firewall, or updates the rules of
+// one left behind by a previous run, and applies it to the server create
+// options
+func (h *Hetzner) upsertFirewall(ctx context.Context, req *hcloud.ServerCreateOpts) error {
+	if h.firewall == nil {
+		return nil
+	}
+
+	firewalls, err := h.firewallsByMachineID(ctx, req.Name)
+	if err != nil {
+		return err
+	}
+
+	var fw *hcloud.Firewall
+	if len(firewalls) > 0 {
+		fw = firewalls[0]
+
+		log.Default.Infof("Updating firewall rules: %s", fw.Name)
+
+		actions, _, err := h.client.Firewall.SetRules(ctx, fw, hcloud.FirewallSetRulesOpts{
+			Rules: h.firewallRules(),
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := waitForActions(ctx, h.client.Action, actions); err != nil {
+			log.Default.Errorf("Error in firewall set rules action: %s", err)
+			return err
+		}
+	} else {
+		log.Default.Infof("Creating firewall: %s", req.Name)
+
+		result, _, err := h.client.Firewall.Create(ctx, hcloud.FirewallCreateOpts{
+			Name:   req.Name,
+			Labels: h.resourceLabels(req.Name),
+			Rules:  h.firewallRules(),
+		})
+		if err != nil {
+			return err
+		}
+
+		h.record(fmt.Sprintf("firewall %s", req.Name), func(ctx context.Context) error {
+			_, err := h.client.Firewall.Delete(ctx, result.Firewall)
+			return err
+		})
+
+		if err := waitForActions(ctx, h.client.Action, result.Actions); err != nil {
+			log.Default.Errorf("Error in firewall creation action: %s", err)
+			return err
+		}
+
+		fw = result.Firewall
+	}
+
+	req.Firewalls = append(req.Firewalls, &hcloud.ServerCreateFirewall{Firewall: *fw})
+
+	return nil
+}
+
+// applySharedFirewalls adds the existing firewalls, by name and by label
+// selector, to the server create options
+func (h *Hetzner) applySharedFirewalls(ctx context.Context, req *hcloud.ServerCreateOpts) error {
+	firewalls := make([]*hcloud.Firewall, 0)
+
+	for _, name := range h.sharedFirewalls {
+		fw, _, err := h.client.Firewall.GetByName(ctx, name)
+		if err != nil {
+			return err
+		}
+		if fw == nil {
+			return fmt.Errorf("%w: %s", ErrUnknownFirewall, name)
+		}
+		firewalls = append(firewalls, fw)
+	}
+
+	if h.firewallSelector != "" {
+		selected, _, err := h.client.Firewall.List(ctx, hcloud.FirewallListOpts{
+			ListOpts: hcloud.ListOpts{
+				LabelSelector: h.firewallSelector,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("%w: no firewalls match %s", ErrUnknownFirewall, h.firewallSelector)
+		}
+		firewalls = append(firewalls, selected...)
+	}
+
+	for _, fw := range firewalls {
+		if slices.ContainsFunc(req.Firewalls, func(f *hcloud.ServerCreateFirewall) bool { return f.Firewall.ID == fw.ID }) {
+			continue
+		}
+
+		log.Default.Infof("Applying firewall: %s", fw.Name)
+
+		req.Firewalls = append(req.Firewalls, &hcloud.ServerCreateFirewall{Firewall: *fw})
+	}
+
+	return nil
+}
+
+// deleteFirewalls removes the workspace's firewalls. They can only be deleted
+// once they're no longer applied to the server.
+func (h *Hetzner) deleteFirewalls(ctx context.Context, name string) error {
+	firewalls, err := h.firewallsByMachineID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, fw := range firewalls {
+		log.Default.Infof("Deleting firewall: %s", fw.Name)
+
+		if _, err := h.client.Firewall.Delete(ctx, fw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *Hetzner) firewallsByMachineID(ctx context.Context, machineID string) ([]*hcloud.Firewall, error) {
+	firewalls, _, err := h.client.Firewall.List(ctx, hcloud.FirewallListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMachineID, machineID),
+		},
+	})
+
+	return firewalls, err
+}
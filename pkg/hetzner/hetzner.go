@@ -17,14 +17,13 @@
 package hetzner
 
 import (
-	"bytes"
 	"context"
-	"embed"
 	"encoding/base64"
 	"fmt"
+	"maps"
+	"net"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	cryptoSsh "golang.org/x/crypto/ssh"
@@ -35,26 +34,280 @@ import (
 	"github.com/loft-sh/devpod/pkg/ssh"
 	"github.com/loft-sh/log"
 	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
-	hga "github.com/mrsimonemms/hetzner-golang-actions"
 	"github.com/pkg/errors"
-	"gopkg.in/yaml.v3"
 )
 
-//go:embed cloud-config.yaml
-var cloudConfig embed.FS
+type Hetzner struct {
+	addressPreference []options.AddressType
+	allowUnknownKeys  bool
+	client            *CloudClient
+	clientOptions     []hcloud.ClientOption
+	cloudInitExtra    string
+	containerRuntime  options.ContainerRuntime
+	extraVolumes      []options.ExtraVolume
+	firewall          *firewall
+	sharedFirewalls   []string
+	firewallSelector  string
+	jumpHost          *jumpHost
+	labels            map[string]string
+	network           string
+	options           *options.Options
+	networkIP         net.IP
+	placementGroup    string
+	persistentVolume  bool
+	primaryIPs        bool
+	publicIPv4        bool
+	publicIPv6        bool
+	provisionTimeout  time.Duration
+	rollback          bool
+	sshPort           int
+	tx                *transaction
+	userDataIncludes  []string
+	userDataScripts   []string
+	volume            volumeMount
+
+	// warnedKeys are the unknown cloud-config keys already warned about
+	warnedKeys map[string]bool
+
+	// connect checks the provisioning status of a server - replaceable in tests
+	connect func(ctx context.Context, server *hcloud.Server, privateKeyFile []byte) (*cloudInit, error)
+}
+
+type Option func(*Hetzner)
+
+// WithAddressPreference sets the order in which a server's addresses are
+// tried when connecting to it
+func WithAddressPreference(preference []options.AddressType) Option {
+	return func(h *Hetzner) {
+		if len(preference) > 0 {
+			h.addressPreference = preference
+		}
+	}
+}
 
-type cloudInit struct {
-	Status string `json:"status"`
+// WithCloudClient replaces the default hcloud-go client, eg with a fake
+func WithCloudClient(client *CloudClient) Option {
+	return func(h *Hetzner) {
+		h.client = client
+	}
 }
 
-type Hetzner struct {
-	client *hcloud.Client
+// WithCloudInit deep-merges the extra YAML, or the file it's the path to,
+// into the generated cloud-config. The provider options are available to both
+// templates as .Options, without the API token as anyone on the server can
+// read the user-data.
+func WithCloudInit(extra string, opts *options.Options) Option {
+	return func(h *Hetzner) {
+		h.cloudInitExtra = extra
+		h.options = nil
+		if opts != nil {
+			public := *opts
+			public.Token = ""
+			h.options = &public
+		}
+	}
+}
+
+// WithCloudConfigUnknownKeys allows top-level cloud-config keys which aren't
+// known to the provider, rather than rejecting them as a likely typo
+func WithCloudConfigUnknownKeys(allow bool) Option {
+	return func(h *Hetzner) {
+		h.allowUnknownKeys = allow
+	}
+}
+
+// WithContainerRuntime sets how the container runtime is installed. If empty,
+// it's chosen from the server's image.
+func WithContainerRuntime(runtime options.ContainerRuntime) Option {
+	return func(h *Hetzner) {
+		h.containerRuntime = runtime
+	}
+}
+
+// WithEndpoint sets the Hetzner Cloud API endpoint - an empty string uses the default
+func WithEndpoint(endpoint string) Option {
+	return func(h *Hetzner) {
+		if endpoint != "" {
+			h.clientOptions = append(h.clientOptions, hcloud.WithEndpoint(endpoint))
+		}
+	}
+}
+
+// WithExtraVolumes gives each workspace additional volumes, mounted at their
+// paths and deleted with the workspace
+func WithExtraVolumes(volumes []options.ExtraVolume) Option {
+	return func(h *Hetzner) {
+		h.extraVolumes = volumes
+	}
+}
+
+// WithFirewall creates a firewall for each workspace, allowing SSH from the
+// given sources plus any extra rules
+func WithFirewall(enabled bool, sshSources []net.IPNet, rules []options.FirewallRule) Option {
+	return func(h *Hetzner) {
+		if enabled {
+			h.firewall = &firewall{sshSources: sshSources, rules: rules}
+		}
+	}
+}
+
+// WithJumpHost connects to servers through an SSH jump host. If the private
+// key file is empty, the workspace's key is used.
+func WithJumpHost(user, address, privateKeyFile string) Option {
+	return func(h *Hetzner) {
+		if address != "" {
+			h.jumpHost = &jumpHost{user: user, address: address, privateKeyFile: privateKeyFile}
+		}
+	}
+}
+
+// WithLabels adds user-defined labels to every resource the provider creates
+func WithLabels(labels map[string]string) Option {
+	return func(h *Hetzner) {
+		h.labels = labels
+	}
+}
+
+// WithNetwork joins servers to an existing private network, given by name or
+// ID. The IP is optional - if nil, Hetzner assigns one.
+func WithNetwork(network string, ip net.IP) Option {
+	return func(h *Hetzner) {
+		h.network = network
+		h.networkIP = ip
+	}
+}
+
+// WithPersistentVolume sets whether the workspace has a volume which is kept
+// when it's stopped. It is enabled by default.
+func WithPersistentVolume(enabled bool) Option {
+	return func(h *Hetzner) {
+		h.persistentVolume = enabled
+	}
+}
+
+// WithPlacementGroup spreads the servers across hosts with the named placement
+// group, creating it if it doesn't exist
+func WithPlacementGroup(name string) Option {
+	return func(h *Hetzner) {
+		h.placementGroup = name
+	}
+}
+
+// WithPrimaryIPs keeps the server's public IPs when it's deleted on stop, by
+// creating them as Primary IPs which are only released on delete
+func WithPrimaryIPs(enabled bool) Option {
+	return func(h *Hetzner) {
+		h.primaryIPs = enabled
+	}
+}
+
+// WithProvisionTimeout sets how long to wait for cloud-init to finish
+// provisioning a new server
+func WithProvisionTimeout(timeout time.Duration) Option {
+	return func(h *Hetzner) {
+		h.provisionTimeout = timeout
+	}
+}
+
+// WithPublicNet sets whether servers get a public IPv4 and IPv6 address.
+// Both are enabled by default.
+func WithPublicNet(ipv4, ipv6 bool) Option {
+	return func(h *Hetzner) {
+		h.publicIPv4 = ipv4
+		h.publicIPv6 = ipv6
+	}
+}
+
+// WithRollback controls whether resources created by a failed Create are
+// removed. It is enabled by default.
+func WithRollback(rollback bool) Option {
+	return func(h *Hetzner) {
+		h.rollback = rollback
+	}
+}
+
+// WithSharedFirewalls applies existing firewalls to the servers, given by name
+// or matched by a label selector
+func WithSharedFirewalls(names []string, selector string) Option {
+	return func(h *Hetzner) {
+		h.sharedFirewalls = names
+		h.firewallSelector = selector
+	}
+}
+
+// WithSSHPort sets the port used to connect to the servers
+func WithSSHPort(port int) Option {
+	return func(h *Hetzner) {
+		h.sshPort = port
+	}
+}
+
+// WithUserDataParts sends the shell scripts, read from the paths when the
+// server is created, and #include URLs alongside the cloud-config as a MIME
+// multipart user-data document
+func WithUserDataParts(scripts, includes []string) Option {
+	return func(h *Hetzner) {
+		h.userDataScripts = scripts
+		h.userDataIncludes = includes
+	}
+}
+
+// WithVolume sets the filesystem the volume is formatted with, where it's
+// mounted and the mount options. Empty values are left as the default.
+func WithVolume(filesystem, mountPath, mountOptions string) Option {
+	return func(h *Hetzner) {
+		if filesystem != "" {
+			h.volume.Filesystem = filesystem
+		}
+		if mountPath != "" {
+			h.volume.MountPath = mountPath
+		}
+		if mountOptions != "" {
+			h.volume.Options = mountOptions
+		}
+	}
+}
+
+func NewHetzner(token string, opts ...Option) *Hetzner {
+	h := &Hetzner{
+		addressPreference: options.DefaultAddressPreference,
+		options:           &options.Options{},
+		persistentVolume:  true,
+		provisionTimeout:  defaultProvisionTimeout,
+		publicIPv4:        true,
+		publicIPv6:        true,
+		rollback:          true,
+		sshPort:           SSHPort,
+		volume:            defaultVolumeMount,
+		warnedKeys:        map[string]bool{},
+	}
+	h.connect = h.attemptConnection
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.client == nil {
+		clientOptions := append([]hcloud.ClientOption{hcloud.WithToken(token)}, h.clientOptions...)
+		h.client = NewCloudClient(hcloud.NewClient(clientOptions...))
+	}
+
+	return h
 }
 
-func NewHetzner(token string) *Hetzner {
-	return &Hetzner{
-		client: hcloud.NewClient(hcloud.WithToken(token)),
+// resourceLabels are the labels for a resource created by the provider - the
+// user-defined labels plus those used to find it again. Resources shared
+// between workspaces have no machine ID.
+func (h *Hetzner) resourceLabels(machineID string) map[string]string {
+	labels := make(map[string]string, len(h.labels)+2)
+	maps.Copy(labels, h.labels)
+
+	labels["type"] = "devpod"
+	if machineID != "" {
+		labels[labelMachineID] = machineID
 	}
+
+	return labels
 }
 
 func (h *Hetzner) upsertPublicKey(ctx context.Context, publicKey, machineID string) (*hcloud.SSHKey, error) {
@@ -81,15 +334,17 @@ func (h *Hetzner) upsertPublicKey(ctx context.Context, publicKey, machineID stri
 		uploadedSSHKey, _, err := h.client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{
 			Name:      name,
 			PublicKey: publicKey,
-			Labels: map[string]string{
-				"type":         "devpod",
-				labelMachineID: machineID,
-			},
+			Labels:    h.resourceLabels(machineID),
 		})
 		if err != nil {
 			return nil, err
 		}
 
+		h.record(fmt.Sprintf("SSH key %s", name), func(ctx context.Context) error {
+			_, err := h.client.SSHKey.Delete(ctx, uploadedSSHKey)
+			return err
+		})
+
 		sshKey = uploadedSSHKey
 	}
 
@@ -102,6 +357,10 @@ func (h *Hetzner) BuildServerOptions(
 ) (serverCreateOpts *hcloud.ServerCreateOpts, publicKeyStr *string, privateKey []byte, err error) {
 	log.Default.Debugf("Machine folder path: %s", opts.MachineFolder)
 
+	// Start a new transaction - this is continued by Create
+	h.tx = &transaction{}
+	defer h.rollbackOnError(ctx, &err)
+
 	publicKeyBase, err := ssh.GetPublicKeyBase(opts.MachineFolder)
 	if err != nil {
 		return nil, nil, nil, err
@@ -133,87 +392,142 @@ func (h *Hetzner) BuildServerOptions(
 		return nil, nil, nil, ErrUnknownMachineID
 	}
 
-	sshKey, err := h.upsertPublicKey(ctx, string(publicKey), opts.MachineID)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
 	arch := hcloud.ArchitectureX86
 	if strings.HasPrefix(opts.MachineType, "cax") {
 		// Machines starting "cax" are ARM64
 		arch = hcloud.ArchitectureARM
 	}
-	image, _, err := h.client.Image.GetByNameAndArchitecture(ctx, opts.DiskImage, arch)
-	if err != nil {
+
+	// Restore from the latest snapshot if the workspace was stopped with one.
+	// Any snapshots left from before STOP_MODE was changed are ignored.
+	var image *hcloud.Image
+	if opts.StopMode == options.StopModeSnapshot {
+		if image, err = h.latestSnapshot(ctx, opts.MachineID, arch); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if image != nil {
+		log.Default.Infof("Restoring from snapshot: %d", image.ID)
+	} else {
+		image, _, err = h.client.Image.GetByNameAndArchitecture(ctx, opts.DiskImage, arch)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if image == nil {
+			return nil, nil, nil, ErrUnknownDiskImage
+		}
+	}
+
+	// Check the user-data before anything billed is created
+	if err := h.checkUserData(string(publicKey), image); err != nil {
 		return nil, nil, nil, err
 	}
-	if image == nil {
-		return nil, nil, nil, ErrUnknownDiskImage
+
+	sshKey, err := h.upsertPublicKey(ctx, string(publicKey), opts.MachineID)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return &hcloud.ServerCreateOpts{
+	req := &hcloud.ServerCreateOpts{
 		Name:       opts.MachineID,
 		Location:   location,
 		ServerType: serverType,
 		Image:      image,
-		Labels: map[string]string{
-			"type":         "devpod",
-			labelMachineID: opts.MachineID,
-		},
+		Labels:     h.resourceLabels(opts.MachineID),
 		SSHKeys: []*hcloud.SSHKey{
 			sshKey,
 		},
-	}, hcloud.Ptr(string(publicKey)), privateKey, nil
+	}
+
+	if err := h.configureNetwork(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := h.assignPrimaryIPs(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if req.PlacementGroup, err = h.upsertPlacementGroup(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := h.upsertFirewall(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := h.applySharedFirewalls(ctx, req); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return req, hcloud.Ptr(string(publicKey)), privateKey, nil
 }
 
-func (h *Hetzner) Create(ctx context.Context, req *hcloud.ServerCreateOpts, diskSize int, publicKey string, privateKeyFile []byte) error {
+func (h *Hetzner) Create(
+	ctx context.Context,
+	req *hcloud.ServerCreateOpts,
+	diskSize int,
+	publicKey string,
+	privateKeyFile []byte,
+) (err error) {
 	log.Default.Info("Creating DevPod instance")
 
-	volume, err := h.volumeByName(ctx, req.Name)
+	defer h.rollbackOnError(ctx, &err)
+
+	// Resume a server left behind by a previous run, eg one which timed out
+	// while provisioning. If cloud-init failed on it, it's created again.
+	existing, err := h.serverByMachineID(ctx, req.Name)
 	if err != nil {
 		return err
 	}
+	if existing != nil {
+		if !h.provisionFailed(ctx, existing, privateKeyFile) {
+			volumes, err := h.keptVolumes(ctx, req.Name, diskSize)
+			if err != nil {
+				return err
+			}
+			return h.resume(ctx, existing, volumes, privateKeyFile)
+		}
 
-	if volume == nil {
-		// Create the volume as it doesn't exist
-		log.Default.Info("Creating a new volume")
-
-		result, _, err := h.client.Volume.Create(ctx, hcloud.VolumeCreateOpts{
-			Location:  req.Location,
-			Name:      req.Name,
-			Size:      diskSize,
-			Format:    hcloud.Ptr("ext4"),
-			Automount: hcloud.Ptr(false),
-			Labels:    req.Labels,
-		})
-		if err != nil {
+		log.Default.Warnf("Deleting server %s and creating it again, keeping its volumes", existing.Name)
+		if err := h.deleteServer(ctx, existing); err != nil {
 			return err
 		}
+	}
 
-		if err := hga.NewWaiter(h.client).Wait(ctx, result.Action, result.NextActions...); err != nil {
-			log.Default.Errorf("Error in volume creation action: %s", err)
+	var volume *hcloud.Volume
+	if h.persistentVolume {
+		if volume, err = h.upsertVolume(ctx, req, req.Name, mainVolumeRole, diskSize); err != nil {
 			return err
 		}
+	}
 
-		log.Default.Info("Volume successfully created")
+	extraVolumes, err := h.upsertExtraVolumes(ctx, req)
+	if err != nil {
+		return err
+	}
 
-		volume = result.Volume
+	volumes := extraVolumes
+	if volume != nil {
+		volumes = append([]*hcloud.Volume{volume}, extraVolumes...)
+	}
+
+	volumeID := int64(0)
+	if volume != nil {
+		volumeID = volume.ID
+	}
+
+	// Add the volumes to the server config
+	for _, v := range volumes {
+		req.Volumes = append(req.Volumes, &hcloud.Volume{ID: v.ID})
 	}
 
 	// Generate the config init
-	userData, err := generateUserData(req.Name, publicKey, volume.ID)
+	userData, err := h.generateUserData(publicKey, volumeID, extraVolumes, req.Image)
 	if err != nil {
 		return err
 	}
 	// Add to server config
-	req.UserData = userData.String()
-
-	// Add volume to the server config
-	req.Volumes = []*hcloud.Volume{
-		{
-			ID: volume.ID,
-		},
-	}
+	req.UserData = userData
 
 	// Create the server
 	log.Default.Info("Creating a new server")
@@ -222,34 +536,70 @@ func (h *Hetzner) Create(ctx context.Context, req *hcloud.ServerCreateOpts, disk
 		return err
 	}
 
+	h.record(fmt.Sprintf("server %s", req.Name), func(ctx context.Context) error {
+		result, _, err := h.client.Server.DeleteWithResult(ctx, server.Server)
+		if err != nil {
+			return err
+		}
+		return h.client.Action.Wait(ctx, result.Action)
+	})
+
 	log.Default.Info("Server creation triggered")
 
-	if err := hga.NewWaiter(h.client).Wait(ctx, server.Action, server.NextActions...); err != nil {
+	if err := h.client.Action.Wait(ctx, server.Action, server.NextActions...); err != nil {
 		log.Default.Errorf("Error in server creation action: %s", err)
 		return err
 	}
 
+	if server.Server, err = h.joinNetwork(ctx, server.Server); err != nil {
+		return err
+	}
+
 	log.Default.Info("Server created - provisioning")
 
-	attempt := 0
+	if err := h.waitForProvisioning(ctx, server.Server, privateKeyFile); err != nil {
+		return err
+	}
 
-	for {
-		if attempt >= maxServerConnectAttempts {
-			return fmt.Errorf("exceeded attempts to connect to server: %d", attempt)
+	log.Default.Info("Server provisioned")
+
+	// Everything was created successfully - there's nothing to roll back
+	h.tx = nil
+
+	// The snapshot the server was restored from isn't needed now it's healthy.
+	// The next stop takes a new one.
+	if req.Image.Type == hcloud.ImageTypeSnapshot && req.Image.Labels[labelMachineID] == req.Name {
+		log.Default.Infof("Deleting snapshot: %d", req.Image.ID)
+		if _, err := h.client.Image.Delete(ctx, req.Image); err != nil {
+			log.Default.Warnf("Unable to delete snapshot %d: %v", req.Image.ID, err)
 		}
-		attempt++
-		log.Default.Debugf("Attempt %d of %d", attempt, maxServerConnectAttempts)
+	}
 
-		time.Sleep(time.Second)
+	return nil
+}
 
-		status := attemptConnection(ctx, server, privateKeyFile)
+// resume reuses an existing server, powering it on and attaching the volumes
+// if required, and waits for it to finish provisioning
+func (h *Hetzner) resume(ctx context.Context, server *hcloud.Server, volumes []*hcloud.Volume, privateKeyFile []byte) error {
+	log.Default.Infof("Resuming existing server: %s", server.Name)
 
-		if status != nil && status.Status == "done" {
-			// The server is ready
-			break
+	switch server.Status {
+	case hcloud.ServerStatusDeleting:
+		return ErrServerDeleting(server.Name)
+	case hcloud.ServerStatusOff:
+		if err := h.powerOn(ctx, server); err != nil {
+			return err
 		}
+	}
 
-		log.Default.Debug("Server not yet provisioned")
+	for _, volume := range volumes {
+		if err := h.attachVolume(ctx, volume, server); err != nil {
+			return err
+		}
+	}
+
+	if err := h.waitForProvisioning(ctx, server, privateKeyFile); err != nil {
+		return err
 	}
 
 	log.Default.Info("Server provisioned")
@@ -276,24 +626,43 @@ func (h *Hetzner) Delete(ctx context.Context, name string) error {
 		}
 	}
 
-	// Delete volume
-	if err := h.deleteVolume(ctx, name); err != nil {
+	// Delete volumes
+	if err := h.deleteMachineVolumes(ctx, name); err != nil {
+		return err
+	}
+
+	// Delete snapshots
+	if err := h.pruneSnapshots(ctx, name, 0); err != nil {
 		return err
 	}
 
 	server, err := h.GetByName(ctx, name)
 	if err != nil {
 		return err
-	} else if server == nil {
-		return nil
 	}
 
-	result, _, err := h.client.Server.DeleteWithResult(ctx, server)
-	if err != nil {
+	// The server's placement group is removed if it's left empty
+	placementGroup := h.placementGroup
+	if server != nil && server.PlacementGroup != nil {
+		placementGroup = strconv.FormatInt(server.PlacementGroup.ID, 10)
+	}
+
+	if server != nil {
+		if err := h.deleteServer(ctx, server); err != nil {
+			return err
+		}
+	}
+
+	// Delete primary IPs, firewalls and placement groups - they can't be deleted while in use by the server
+	if err := h.deletePrimaryIPs(ctx, name); err != nil {
 		return err
 	}
 
-	return hga.NewWaiter(h.client).Wait(ctx, result.Action)
+	if err := h.deleteFirewalls(ctx, name); err != nil {
+		return err
+	}
+
+	return h.deleteEmptyPlacementGroup(ctx, placementGroup)
 }
 
 func (h *Hetzner) GetByName(ctx context.Context, name string) (*hcloud.Server, error) {
@@ -327,8 +696,28 @@ func (h *Hetzner) Status(ctx context.Context, name string) (client.Status, error
 		return client.StatusNotFound, err
 	}
 	if server == nil {
-		// No server - check the volume
-		volume, err := h.volumeByName(ctx, name)
+		return h.stoppedStatus(ctx, name)
+	}
+
+	// Kept on stop - it can be powered on again
+	if server.Status == hcloud.ServerStatusOff {
+		return client.StatusStopped, nil
+	}
+
+	// Is it busy?
+	if server.Status != hcloud.ServerStatusRunning {
+		return client.StatusBusy, nil
+	}
+
+	return client.StatusRunning, nil
+}
+
+// stoppedStatus is the status of a workspace without a server. It's stopped if
+// there's anything to start it from again - its volume or, without one, its
+// extra volumes or a snapshot.
+func (h *Hetzner) stoppedStatus(ctx context.Context, name string) (client.Status, error) {
+	if h.persistentVolume {
+		volume, err := h.machineVolume(ctx, name, mainVolumeRole)
 		if err != nil {
 			return client.StatusNotFound, err
 		} else if volume != nil {
@@ -338,15 +727,52 @@ func (h *Hetzner) Status(ctx context.Context, name string) (client.Status, error
 		return client.StatusNotFound, nil
 	}
 
-	// Is it busy?
-	if server.Status != hcloud.ServerStatusRunning {
-		return client.StatusBusy, nil
+	if len(h.extraVolumes) > 0 {
+		volumes, err := h.volumesByMachineID(ctx, name)
+		if err != nil {
+			return client.StatusNotFound, err
+		} else if len(volumes) > 0 {
+			return client.StatusStopped, nil
+		}
 	}
 
-	return client.StatusRunning, nil
+	snapshots, err := h.listSnapshots(ctx, name)
+	if err != nil {
+		return client.StatusNotFound, err
+	} else if len(snapshots) > 0 {
+		return client.StatusStopped, nil
+	}
+
+	return client.StatusNotFound, nil
 }
 
-func (h *Hetzner) Stop(ctx context.Context, name string) error {
+// Start powers on a server that was kept when it was stopped, growing its
+// volumes if their sizes have increased. It returns false if there is no
+// stopped server, in which case it needs creating.
+func (h *Hetzner) Start(ctx context.Context, name string, diskSize int, privateKeyFile []byte) (bool, error) {
+	server, err := h.GetByName(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if server == nil || server.Status != hcloud.ServerStatusOff {
+		return false, nil
+	}
+
+	volumes, err := h.keptVolumes(ctx, name, diskSize)
+	if err != nil {
+		return false, err
+	}
+
+	if err := h.resume(ctx, server, volumes, privateKeyFile); err != nil {
+		return false, err
+	}
+
+	log.Default.Info("Server started")
+
+	return true, nil
+}
+
+func (h *Hetzner) Stop(ctx context.Context, name string, mode options.StopMode) error {
 	server, err := h.GetByName(ctx, name)
 	if err != nil {
 		return err
@@ -355,26 +781,102 @@ func (h *Hetzner) Stop(ctx context.Context, name string) error {
 		return nil
 	}
 
+	switch mode {
+	case options.StopModePowerOff:
+		return h.powerOff(ctx, server)
+	case options.StopModeShutdown:
+		return h.shutdown(ctx, server)
+	case options.StopModeSnapshot:
+		return h.snapshot(ctx, server)
+	}
+
+	return h.deleteServer(ctx, server)
+}
+
+// deleteServer deletes the server, which detaches its volumes and primary
+// IPs, and waits for it to go
+func (h *Hetzner) deleteServer(ctx context.Context, server *hcloud.Server) error {
 	result, _, err := h.client.Server.DeleteWithResult(ctx, server)
 	if err != nil {
 		return err
 	}
 
-	return hga.NewWaiter(h.client).Wait(ctx, result.Action)
+	return h.client.Action.Wait(ctx, result.Action)
 }
 
-func (h *Hetzner) deleteVolume(ctx context.Context, name string) error {
-	volume, err := h.volumeByName(ctx, name)
+func (h *Hetzner) powerOn(ctx context.Context, server *hcloud.Server) error {
+	log.Default.Info("Powering on server")
+
+	action, _, err := h.client.Server.Poweron(ctx, server)
 	if err != nil {
 		return err
-	} else if volume != nil && volume.Server != nil {
+	}
+
+	if err := h.client.Action.Wait(ctx, action); err != nil {
+		log.Default.Errorf("Error in server power on action: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (h *Hetzner) powerOff(ctx context.Context, server *hcloud.Server) error {
+	if server.Status == hcloud.ServerStatusOff {
+		return nil
+	}
+
+	log.Default.Info("Powering off server")
+
+	action, _, err := h.client.Server.Poweroff(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	return h.client.Action.Wait(ctx, action)
+}
+
+func (h *Hetzner) shutdown(ctx context.Context, server *hcloud.Server) error {
+	if server.Status == hcloud.ServerStatusOff {
+		return nil
+	}
+
+	log.Default.Info("Shutting down server")
+
+	action, _, err := h.client.Server.Shutdown(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	if err := h.client.Action.Wait(ctx, action); err != nil {
+		return err
+	}
+
+	// The action only sends the ACPI signal - wait for the OS to finish
+	for attempt := 0; attempt < maxShutdownAttempts; attempt++ {
+		time.Sleep(time.Second)
+
+		server, err = h.GetByName(ctx, server.Name)
+		if err != nil {
+			return err
+		} else if server == nil || server.Status == hcloud.ServerStatusOff {
+			return nil
+		}
+	}
+
+	log.Default.Warn("Server did not shut down gracefully - powering off")
+
+	return h.powerOff(ctx, server)
+}
+
+func (h *Hetzner) deleteVolume(ctx context.Context, volume *hcloud.Volume) error {
+	if volume.Server != nil {
 		// Detatch volume
 		action, _, err := h.client.Volume.Detach(ctx, volume)
 		if err != nil {
 			return errors.Wrap(err, "detach volume")
 		}
 
-		if err := hga.NewWaiter(h.client).Wait(ctx, action); err != nil {
+		if err := h.client.Action.Wait(ctx, action); err != nil {
 			log.Default.Errorf("Error in volume detach action: %s, %s", action.Command, err)
 			return err
 		}
@@ -385,7 +887,8 @@ func (h *Hetzner) deleteVolume(ctx context.Context, name string) error {
 		time.Sleep(time.Second)
 
 		// re-get volume
-		volume, err = h.volumeByName(ctx, name)
+		var err error
+		volume, _, err = h.client.Volume.GetByID(ctx, volume.ID)
 		if err != nil {
 			return err
 		} else if volume == nil || volume.Server == nil {
@@ -395,8 +898,7 @@ func (h *Hetzner) deleteVolume(ctx context.Context, name string) error {
 
 	// delete volume
 	if volume != nil {
-		_, err = h.client.Volume.Delete(ctx, volume)
-		if err != nil {
+		if _, err := h.client.Volume.Delete(ctx, volume); err != nil {
 			return errors.Wrap(err, "delete volume")
 		}
 	}
@@ -404,51 +906,53 @@ func (h *Hetzner) deleteVolume(ctx context.Context, name string) error {
 	return nil
 }
 
-func (h *Hetzner) volumeByName(ctx context.Context, name string) (*hcloud.Volume, error) {
-	volumes, _, err := h.client.Volume.List(ctx, hcloud.VolumeListOpts{
-		Name: name,
-	})
-	if err != nil {
-		return nil, err
+// resizeVolume grows the volume to the disk size. The filesystem is grown
+// by cloud-init the next time the server boots.
+func (h *Hetzner) resizeVolume(ctx context.Context, volume *hcloud.Volume, diskSize int) error {
+	if diskSize < volume.Size {
+		return ErrVolumeShrink(volume.Name, volume.Size, diskSize)
 	}
+	if diskSize == volume.Size {
+		return nil
+	}
+
+	log.Default.Infof("Resizing volume from %dGB to %dGB", volume.Size, diskSize)
 
-	volLen := len(volumes)
-	if volLen > 1 {
-		return nil, ErrMultipleVolumesFound(name)
+	action, _, err := h.client.Volume.Resize(ctx, volume, diskSize)
+	if err != nil {
+		return errors.Wrap(err, "resize volume")
 	}
-	if volLen == 0 {
-		return nil, nil
+
+	if err := h.client.Action.Wait(ctx, action); err != nil {
+		log.Default.Errorf("Error in volume resize action: %s", err)
+		return err
 	}
 
-	return volumes[0], nil
-}
+	volume.Size = diskSize
 
-func attemptConnection(ctx context.Context, server hcloud.ServerCreateResult, privateKeyFile []byte) *cloudInit {
-	log.Default.Debug("Checking server provision status")
+	return nil
+}
 
-	// Check the server is provisioned - this runs "ssh user@path cloud-init status"
-	sshClient, err := ssh.NewSSHClient(SSHUsername, fmt.Sprintf("%s:%d", server.Server.PublicNet.IPv4.IP, SSHPort), privateKeyFile)
+// serverByMachineID finds the server created for the machine by its label
+func (h *Hetzner) serverByMachineID(ctx context.Context, machineID string) (*hcloud.Server, error) {
+	servers, _, err := h.client.Server.List(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMachineID, machineID),
+		},
+	})
 	if err != nil {
-		log.Default.Warnf("Unable to connect to server: %v", err)
-		return nil
+		return nil, err
 	}
-	defer func() {
-		err = sshClient.Close()
-	}()
 
-	buf := new(bytes.Buffer)
-	if err := ssh.Run(ctx, sshClient, "cloud-init status || true", &bytes.Buffer{}, buf, &bytes.Buffer{}, nil); err != nil {
-		log.Default.Errorf("Error retrieving cloud-init status, %v", err)
-		return nil
+	serverLength := len(servers)
+	if serverLength > 1 {
+		return nil, ErrMultipleServersFound(machineID)
 	}
-
-	var status cloudInit
-	if err := yaml.Unmarshal(buf.Bytes(), &status); err != nil {
-		log.Default.Errorf("Unable to parse cloud-init YAML: %v", err)
-		return nil
+	if serverLength == 0 {
+		return nil, nil
 	}
 
-	return &status
+	return servers[0], nil
 }
 
 func generateSSHKeyFingerprint(publicKey string) (string, error) {
@@ -460,21 +964,3 @@ func generateSSHKeyFingerprint(publicKey string) (string, error) {
 
 	return cryptoSsh.FingerprintLegacyMD5(pk), nil
 }
-
-func generateUserData(_, publicKey string, volumeID int64) (*bytes.Buffer, error) {
-	t, err := template.New("cloud-config.yaml").ParseFS(cloudConfig, "cloud-config.yaml")
-	if err != nil {
-		return nil, err
-	}
-
-	buf := new(bytes.Buffer)
-	if err := t.Execute(buf, map[string]string{
-		"PublicKey": strings.TrimSuffix(publicKey, "\n"),
-		"VolumeID":  strconv.FormatInt(volumeID, 10),
-		"Username":  SSHUsername,
-	}); err != nil {
-		return nil, err
-	}
-
-	return buf, nil
-}
@@ -17,10 +17,28 @@
 package hetzner
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/client"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestFingerPrintGenerate(t *testing.T) {
@@ -67,3 +85,1663 @@ func TestFingerPrintGenerate(t *testing.T) {
 		})
 	}
 }
+
+func newTestHetzner(t *testing.T, f *fakeCloud) *Hetzner {
+	t.Helper()
+
+	h := NewHetzner("", WithCloudClient(f.client()))
+	h.connect = func(context.Context, *hcloud.Server, []byte) (*cloudInit, error) {
+		return &cloudInit{Status: "done"}, nil
+	}
+
+	return h
+}
+
+func testOptions(t *testing.T) *options.Options {
+	t.Helper()
+
+	return &options.Options{
+		MachineID:     "devpod-test",
+		MachineFolder: t.TempDir(),
+		Region:        "nbg1",
+		DiskImage:     "docker-ce",
+		DiskSize:      30,
+		MachineType:   "cx22",
+	}
+}
+
+func TestBuildServerOptions(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Modify       func(*options.Options)
+		Architecture hcloud.Architecture
+		Error        error
+	}{
+		{
+			Name:         "x86",
+			Architecture: hcloud.ArchitectureX86,
+		},
+		{
+			Name: "arm",
+			Modify: func(o *options.Options) {
+				o.MachineType = "cax11"
+			},
+			Architecture: hcloud.ArchitectureARM,
+		},
+		{
+			Name: "unknown region",
+			Modify: func(o *options.Options) {
+				o.Region = "unknown"
+			},
+			Error: ErrUnknownRegion,
+		},
+		{
+			Name: "unknown machine type",
+			Modify: func(o *options.Options) {
+				o.MachineType = "unknown"
+			},
+			Error: ErrUnknownMachineID,
+		},
+		{
+			Name: "unknown image",
+			Modify: func(o *options.Options) {
+				o.DiskImage = "unknown"
+			},
+			Error: ErrUnknownDiskImage,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+
+			opts := testOptions(t)
+			if test.Modify != nil {
+				test.Modify(opts)
+			}
+
+			req, publicKey, privateKey, err := h.BuildServerOptions(context.Background(), opts)
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NotNil(t, publicKey)
+			assert.NotEmpty(t, privateKey)
+			assert.Equal(t, opts.MachineID, req.Name)
+			assert.Equal(t, test.Architecture, req.Image.Architecture)
+			assert.Equal(t, opts.MachineID, req.Labels[labelMachineID])
+			assert.Len(t, req.SSHKeys, 1)
+			assert.Len(t, f.sshKeys, 1)
+		})
+	}
+}
+
+func TestBuildServerOptionsReusesSSHKey(t *testing.T) {
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	for range 2 {
+		_, _, _, err := h.BuildServerOptions(context.Background(), opts)
+		assert.NoError(t, err)
+	}
+
+	assert.Len(t, f.sshKeys, 1)
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.Len(t, f.servers, 1)
+	assert.Len(t, f.volumes, 1)
+	assert.Equal(t, 30, f.volumes[0].Size)
+	assert.Equal(t, f.servers[0].ID, f.volumes[0].Server.ID)
+	assert.Contains(t, req.UserData, fmt.Sprintf("scsi-0HC_Volume_%d", f.volumes[0].ID))
+
+	status, err := h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusRunning), status)
+}
+
+func TestCreateReusesVolume(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	volumeID := f.volumes[0].ID
+
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.Len(t, f.volumes, 1)
+	assert.Equal(t, volumeID, f.volumes[0].ID)
+	assert.Len(t, f.servers, 1)
+}
+
+func TestCreateResizesVolume(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.Contains(t, req.UserData, "resize2fs")
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	volumeID := f.volumes[0].ID
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 50, *publicKey, privateKey))
+
+	if assert.Len(t, f.volumes, 1) {
+		assert.Equal(t, volumeID, f.volumes[0].ID)
+		assert.Equal(t, 50, f.volumes[0].Size)
+	}
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, h.Create(ctx, req, 30, *publicKey, privateKey), "can't be shrunk to 30GB")
+	assert.Equal(t, 50, f.volumes[0].Size)
+	assert.Empty(t, f.servers)
+}
+
+func TestCreateVolumeMount(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithVolume("xfs", "/workspaces", "noatime,nofail")(h)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	if assert.Len(t, f.volumes, 1) {
+		assert.Equal(t, hcloud.Ptr("xfs"), f.volumes[0].Format)
+	}
+
+	var config map[string]any
+	assert.NoError(t, yaml.Unmarshal([]byte(req.UserData), &config))
+	assert.Equal(t, []any{[]any{
+		fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", f.volumes[0].ID),
+		"/workspaces",
+		"xfs",
+		"noatime,nofail",
+		"0",
+		"0",
+	}}, config["mounts"])
+	assert.Contains(t, config["packages"], "xfsprogs")
+	assert.Contains(t, req.UserData, `xfs_growfs "$2"`)
+	assert.Contains(t, req.UserData, fmt.Sprintf(`grow /dev/disk/by-id/scsi-0HC_Volume_%d "/workspaces"`, f.volumes[0].ID))
+
+	// The volume can't be mounted as a different filesystem
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+	WithVolume("ext4", "", "")(h)
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, h.Create(ctx, req, 30, *publicKey, privateKey), "is formatted as xfs and can't be mounted as ext4")
+	assert.Empty(t, f.servers)
+}
+
+func TestCreateEphemeral(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithPersistentVolume(false)(h)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.Len(t, f.servers, 1)
+	assert.Empty(t, f.volumes)
+	assert.Empty(t, req.Volumes)
+
+	var config map[string]any
+	assert.NoError(t, yaml.Unmarshal([]byte(req.UserData), &config))
+	assert.NotContains(t, config, "mounts")
+	assert.NotContains(t, req.UserData, "resize2fs")
+
+	status, err := h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusRunning), status)
+
+	// A leftover volume doesn't make it stopped
+	f.volumes = append(f.volumes, &hcloud.Volume{ID: f.id(), Name: opts.MachineID, Size: 30})
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	status, err = h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusNotFound), status)
+}
+
+func TestCreateExtraVolumes(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithExtraVolumes([]options.ExtraVolume{
+		{Name: "docker", Size: 50, Path: "/var/lib/docker"},
+		{Name: "cache", Size: 20, Path: "/srv/cache"},
+	})(h)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	if !assert.Len(t, f.volumes, 3) {
+		return
+	}
+	docker, cache := f.volumes[1], f.volumes[2]
+	assert.Equal(t, opts.MachineID+".docker", docker.Name)
+	assert.Equal(t, "extra-docker", docker.Labels[labelVolume])
+	assert.Equal(t, 50, docker.Size)
+	assert.Equal(t, opts.MachineID+".cache", cache.Name)
+	assert.Equal(t, 20, cache.Size)
+	assert.Len(t, req.Volumes, 3)
+
+	for _, v := range f.volumes {
+		assert.Equal(t, opts.MachineID, v.Labels[labelMachineID])
+		assert.Equal(t, f.servers[0].ID, v.Server.ID)
+	}
+
+	var config map[string]any
+	assert.NoError(t, yaml.Unmarshal([]byte(req.UserData), &config))
+	mounts := config["mounts"].([]any)
+	if assert.Len(t, mounts, 3) {
+		assert.Equal(t, []any{
+			fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", docker.ID),
+			"/var/lib/docker",
+			"ext4",
+			"discard,nofail,defaults",
+			"0",
+			"0",
+		}, mounts[1])
+		assert.Equal(t, "/srv/cache", mounts[2].([]any)[1])
+	}
+
+	// Kept when the server is deleted and grown when the size increases
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+	WithExtraVolumes([]options.ExtraVolume{
+		{Name: "docker", Size: 60, Path: "/var/lib/docker"},
+		{Name: "cache", Size: 20, Path: "/srv/cache"},
+	})(h)
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.Len(t, f.volumes, 3)
+	assert.Equal(t, 60, docker.Size)
+
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+	assert.Empty(t, f.volumes)
+}
+
+func TestExtraVolumesOtherWorkspace(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+
+	// Workspace "devpod" with the extra volume "test"
+	h := newTestHetzner(t, f)
+	WithExtraVolumes([]options.ExtraVolume{{Name: "test", Size: 10, Path: "/data"}})(h)
+	opts := testOptions(t)
+	opts.MachineID = "devpod"
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	if !assert.Len(t, f.volumes, 2) {
+		return
+	}
+	extraID := f.volumes[1].ID
+
+	// Workspace "devpod-test" gets its own volume and leaves the other's alone
+	other := newTestHetzner(t, f)
+	otherOpts := testOptions(t)
+
+	req, publicKey, privateKey, err = other.BuildServerOptions(ctx, otherOpts)
+	assert.NoError(t, err)
+	assert.NoError(t, other.Create(ctx, req, 30, *publicKey, privateKey))
+	if assert.Len(t, f.volumes, 3) {
+		assert.NotEqual(t, extraID, f.volumes[2].ID)
+		assert.Equal(t, otherOpts.MachineID, f.volumes[2].Labels[labelMachineID])
+	}
+
+	assert.NoError(t, other.Delete(ctx, otherOpts.MachineID))
+	if assert.Len(t, f.volumes, 2) {
+		assert.Equal(t, extraID, f.volumes[1].ID)
+	}
+}
+
+func TestCreateActionError(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+
+	f.waitErr = errors.New("action failed")
+	assert.ErrorIs(t, h.Create(ctx, req, 30, *publicKey, privateKey), f.waitErr)
+}
+
+func TestCreateRollback(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Rollback       bool
+		ExistingVolume bool
+		Servers        int
+		Volumes        int
+		SSHKeys        int
+		Firewalls      int
+		PrimaryIPs     int
+	}{
+		{
+			Name:     "removes created resources",
+			Rollback: true,
+		},
+		{
+			Name:           "keeps existing volume",
+			Rollback:       true,
+			ExistingVolume: true,
+			Volumes:        1,
+		},
+		{
+			Name:       "disabled",
+			Rollback:   false,
+			Servers:    1,
+			Volumes:    1,
+			SSHKeys:    1,
+			Firewalls:  1,
+			PrimaryIPs: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+			WithRollback(test.Rollback)(h)
+			WithFirewall(true, nil, nil)(h)
+			WithPrimaryIPs(true)(h)
+			opts := testOptions(t)
+
+			if test.ExistingVolume {
+				// Created before volumes were labelled with their role
+				f.volumes = append(f.volumes, &hcloud.Volume{
+					ID:     f.id(),
+					Name:   opts.MachineID,
+					Size:   30,
+					Labels: map[string]string{labelMachineID: opts.MachineID},
+				})
+			}
+
+			req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+			assert.NoError(t, err)
+
+			f.waitErr = errors.New("action failed")
+			f.failCommand = "create_server"
+			assert.ErrorIs(t, h.Create(ctx, req, 30, *publicKey, privateKey), f.waitErr)
+
+			assert.Len(t, f.servers, test.Servers)
+			assert.Len(t, f.volumes, test.Volumes)
+			assert.Len(t, f.sshKeys, test.SSHKeys)
+			assert.Len(t, f.firewalls, test.Firewalls)
+			assert.Len(t, f.primaryIPs, test.PrimaryIPs)
+		})
+	}
+}
+
+func TestBuildServerOptionsRollback(t *testing.T) {
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+	opts.DiskImage = "unknown"
+
+	_, _, _, err := h.BuildServerOptions(context.Background(), opts)
+	assert.ErrorIs(t, err, ErrUnknownDiskImage)
+
+	assert.Empty(t, f.sshKeys)
+}
+
+func TestWaitForProvisioning(t *testing.T) {
+	sshErr := errors.New("connection refused")
+
+	tests := []struct {
+		Name     string
+		Statuses []string
+		Cancel   bool
+		Timeout  time.Duration
+		Error    error
+		Contains []string
+	}{
+		{
+			Name:     "done",
+			Statuses: []string{"done"},
+		},
+		{
+			Name:     "retries until done",
+			Statuses: []string{"", "running", "done"},
+		},
+		{
+			Name:     "timeout",
+			Statuses: []string{"", "running"},
+			Timeout:  2 * time.Second,
+			Error:    ErrProvisionTimeout,
+			Contains: []string{"last cloud-init status: running", "last SSH error: connection refused"},
+		},
+		{
+			Name:     "cloud-init error",
+			Statuses: []string{"running", "error"},
+			Timeout:  time.Minute,
+			Error:    ErrCloudInitFailed,
+			Contains: []string{"with status error", "diagnostics"},
+		},
+		{
+			Name:     "cancelled",
+			Statuses: []string{""},
+			Cancel:   true,
+			Error:    context.Canceled,
+			Contains: []string{"last cloud-init status: unknown"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			h := NewHetzner("")
+			if test.Timeout > 0 {
+				WithProvisionTimeout(test.Timeout)(h)
+			}
+
+			// An empty status is an SSH failure. The last status is repeated.
+			attempt := 0
+			h.connect = func(context.Context, *hcloud.Server, []byte) (*cloudInit, error) {
+				status := test.Statuses[min(attempt, len(test.Statuses)-1)]
+				attempt++
+				if test.Cancel {
+					cancel()
+				}
+				if status == "" {
+					return nil, sshErr
+				}
+				return &cloudInit{Status: status, Diagnostics: "diagnostics"}, nil
+			}
+
+			err := h.waitForProvisioning(ctx, &hcloud.Server{Name: "devpod-test"}, nil)
+			if test.Error == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, len(test.Statuses), attempt)
+				return
+			}
+
+			assert.ErrorIs(t, err, test.Error)
+			for _, c := range test.Contains {
+				assert.Contains(t, err.Error(), c)
+			}
+		})
+	}
+}
+
+func TestParseCloudInitStatus(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Output string
+		Status string
+		Failed bool
+		Error  bool
+	}{
+		{
+			Name:   "running",
+			Output: "status: running\n",
+			Status: "running",
+		},
+		{
+			Name:   "done",
+			Output: "status: done\nextended_status: done\nboot_status_code: enabled-by-generator\nerrors: []\n",
+			Status: "done",
+		},
+		{
+			Name:   "degraded",
+			Output: "status: done\nextended_status: degraded done\nrecoverable_errors:\n  WARNING:\n  - some warning\n",
+			Status: "done",
+			Failed: true,
+		},
+		{
+			Name:   "error with legacy detail",
+			Output: "status: error\ntime: Thu, 01 Jan 1970 00:00:00 +0000\ndetail:\n('ssh-authkey-fingerprints', KeyError('x'))\n",
+			Status: "error",
+			Failed: true,
+		},
+		{
+			Name:   "not cloud-init",
+			Output: "bash: cloud-init: command not found\n",
+			Error:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			status, err := parseCloudInitStatus(test.Output)
+			if test.Error {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Status, status.Status)
+			assert.Equal(t, test.Failed, status.failed())
+		})
+	}
+}
+
+func TestCreateNetwork(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Network string
+		IP      net.IP
+		Error   error
+	}{
+		{
+			Name:    "by name",
+			Network: "devpod",
+		},
+		{
+			Name:    "by id with ip",
+			Network: "1",
+			IP:      net.ParseIP("10.0.1.10"),
+		},
+		{
+			Name:    "unknown",
+			Network: "unknown",
+			Error:   ErrUnknownNetwork,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+			WithNetwork(test.Network, test.IP)(h)
+
+			var connected *hcloud.Server
+			h.connect = func(_ context.Context, server *hcloud.Server, _ []byte) (*cloudInit, error) {
+				connected = server
+				return &cloudInit{Status: "done"}, nil
+			}
+
+			req, publicKey, privateKey, err := h.BuildServerOptions(ctx, testOptions(t))
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				assert.Empty(t, f.sshKeys)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+			assert.Len(t, f.servers, 1)
+			assert.Equal(t, hcloud.ServerStatusRunning, f.servers[0].Status)
+			if assert.Len(t, connected.PrivateNet, 1) {
+				assert.Equal(t, f.networks[0].ID, connected.PrivateNet[0].Network.ID)
+				if test.IP != nil {
+					assert.True(t, test.IP.Equal(connected.PrivateNet[0].IP))
+				}
+			}
+		})
+	}
+}
+
+func TestSSHAddress(t *testing.T) {
+	_, ipv6, _ := net.ParseCIDR("2001:db8:1::/64")
+	public := hcloud.ServerPublicNet{
+		IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP("203.0.113.1")},
+		IPv6: hcloud.ServerPublicNetIPv6{IP: ipv6.IP, Network: ipv6},
+	}
+	private := []hcloud.ServerPrivateNet{
+		{IP: net.ParseIP("10.0.0.2")},
+	}
+
+	tests := []struct {
+		Name       string
+		Preference []options.AddressType
+		PublicNet  hcloud.ServerPublicNet
+		PrivateNet []hcloud.ServerPrivateNet
+		Address    string
+		Error      error
+	}{
+		{
+			Name:       "default",
+			PublicNet:  public,
+			PrivateNet: private,
+			Address:    "203.0.113.1:22",
+		},
+		{
+			Name:       "ipv6 first",
+			Preference: []options.AddressType{options.AddressIPv6, options.AddressIPv4},
+			PublicNet:  public,
+			Address:    "[2001:db8:1::1]:22",
+		},
+		{
+			Name:       "private first",
+			Preference: []options.AddressType{options.AddressPrivate, options.AddressIPv4},
+			PublicNet:  public,
+			PrivateNet: private,
+			Address:    "10.0.0.2:22",
+		},
+		{
+			Name:      "ipv6 only",
+			PublicNet: hcloud.ServerPublicNet{IPv6: public.IPv6},
+			Address:   "[2001:db8:1::1]:22",
+		},
+		{
+			Name:       "private only",
+			PrivateNet: private,
+			Address:    "10.0.0.2:22",
+		},
+		{
+			Name:       "no preferred address",
+			Preference: []options.AddressType{options.AddressIPv4},
+			PrivateNet: private,
+			Error:      ErrNoServerAddress,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			h := NewHetzner("", WithAddressPreference(test.Preference))
+
+			addr, err := h.SSHAddress(&hcloud.Server{
+				Name:       "devpod-test",
+				PublicNet:  test.PublicNet,
+				PrivateNet: test.PrivateNet,
+			})
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Address, addr)
+		})
+	}
+}
+
+func TestBuildServerOptionsPublicNet(t *testing.T) {
+	f := newFakeCloud()
+	opts := testOptions(t)
+
+	req, _, _, err := newTestHetzner(t, f).BuildServerOptions(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Nil(t, req.PublicNet)
+
+	h := newTestHetzner(t, f)
+	WithPublicNet(false, true)(h)
+	req, _, _, err = h.BuildServerOptions(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, &hcloud.ServerCreatePublicNet{EnableIPv4: false, EnableIPv6: true}, req.PublicNet)
+}
+
+func TestCreateFirewall(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	_, office, _ := net.ParseCIDR("198.51.100.0/24")
+	_, everywhere, _ := net.ParseCIDR("0.0.0.0/0")
+	WithFirewall(true, []net.IPNet{*office}, []options.FirewallRule{
+		{Protocol: "tcp", Port: "80-443", Sources: []net.IPNet{*everywhere}},
+		{Protocol: "icmp", Sources: []net.IPNet{*everywhere}},
+	})(h)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	if assert.Len(t, f.firewalls, 1) {
+		fw := f.firewalls[0]
+		assert.Equal(t, opts.MachineID, fw.Labels[labelMachineID])
+		assert.Len(t, fw.AppliedTo, 1)
+		if assert.Len(t, fw.Rules, 3) {
+			assert.Equal(t, hcloud.FirewallRuleProtocolTCP, fw.Rules[0].Protocol)
+			assert.Equal(t, "22", *fw.Rules[0].Port)
+			assert.Equal(t, []net.IPNet{*office}, fw.Rules[0].SourceIPs)
+			assert.Equal(t, "80-443", *fw.Rules[1].Port)
+			assert.Nil(t, fw.Rules[2].Port)
+		}
+	}
+
+	// The firewall outlives the server and is reused when it's recreated
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+	WithFirewall(true, []net.IPNet{*everywhere}, nil)(h)
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	if assert.Len(t, f.firewalls, 1) {
+		assert.Len(t, f.firewalls[0].Rules, 1)
+		assert.Equal(t, []net.IPNet{*everywhere}, f.firewalls[0].Rules[0].SourceIPs)
+	}
+
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+	assert.Empty(t, f.firewalls)
+}
+
+func TestBuildServerOptionsSharedFirewalls(t *testing.T) {
+	baseline := &hcloud.Firewall{ID: 1, Name: "dev-vm-baseline", Labels: map[string]string{"role": "baseline"}}
+	egress := &hcloud.Firewall{ID: 2, Name: "egress", Labels: map[string]string{"role": "baseline"}}
+
+	tests := []struct {
+		Name      string
+		Names     []string
+		Selector  string
+		Firewalls []int64
+		Error     error
+	}{
+		{
+			Name:      "by name",
+			Names:     []string{"dev-vm-baseline"},
+			Firewalls: []int64{1},
+		},
+		{
+			Name:      "by label selector",
+			Selector:  "role=baseline",
+			Firewalls: []int64{1, 2},
+		},
+		{
+			Name:      "deduplicated",
+			Names:     []string{"egress"},
+			Selector:  "role=baseline",
+			Firewalls: []int64{2, 1},
+		},
+		{
+			Name:  "unknown name",
+			Names: []string{"dev-vm-baseline", "unknown"},
+			Error: ErrUnknownFirewall,
+		},
+		{
+			Name:     "no match",
+			Selector: "role=unknown",
+			Error:    ErrUnknownFirewall,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			f := newFakeCloud()
+			f.firewalls = []*hcloud.Firewall{baseline, egress}
+			h := newTestHetzner(t, f)
+			WithSharedFirewalls(test.Names, test.Selector)(h)
+
+			req, _, _, err := h.BuildServerOptions(context.Background(), testOptions(t))
+			if test.Error != nil {
+				assert.ErrorIs(t, err, test.Error)
+				assert.Empty(t, f.sshKeys)
+				return
+			}
+			assert.NoError(t, err)
+
+			ids := make([]int64, 0)
+			for _, fw := range req.Firewalls {
+				ids = append(ids, fw.Firewall.ID)
+			}
+			assert.Equal(t, test.Firewalls, ids)
+		})
+	}
+}
+
+func TestCreatePrimaryIPs(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithPrimaryIPs(true)(h)
+	opts := testOptions(t)
+
+	create := func() *hcloud.Server {
+		req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+		assert.NoError(t, err)
+		assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+		return f.servers[0]
+	}
+
+	server := create()
+	assert.Len(t, f.primaryIPs, 2)
+	for _, ip := range f.primaryIPs {
+		assert.Equal(t, opts.MachineID, ip.Labels[labelMachineID])
+		assert.Equal(t, server.ID, ip.AssigneeID)
+		assert.False(t, ip.AutoDelete)
+	}
+	ipv4 := server.PublicNet.IPv4.IP
+
+	// The server is recreated with the same IPs
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+	assert.Len(t, f.primaryIPs, 2)
+
+	server = create()
+	assert.Len(t, f.primaryIPs, 2)
+	assert.True(t, ipv4.Equal(server.PublicNet.IPv4.IP))
+
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+	assert.Empty(t, f.primaryIPs)
+}
+
+func TestCreatePrimaryIPsPublicNet(t *testing.T) {
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithPrimaryIPs(true)(h)
+	WithPublicNet(true, false)(h)
+
+	req, _, _, err := h.BuildServerOptions(context.Background(), testOptions(t))
+	assert.NoError(t, err)
+	if assert.Len(t, f.primaryIPs, 1) {
+		assert.Equal(t, hcloud.PrimaryIPTypeIPv4, f.primaryIPs[0].Type)
+		assert.Equal(t, f.primaryIPs[0], req.PublicNet.IPv4)
+	}
+	assert.Nil(t, req.PublicNet.IPv6)
+	assert.False(t, req.PublicNet.EnableIPv6)
+}
+
+func TestCreatePlacementGroup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithPlacementGroup("devpod-spread")(h)
+
+	// Two workspaces share the group
+	first, second := testOptions(t), testOptions(t)
+	second.MachineID = "devpod-test-2"
+	for _, opts := range []*options.Options{first, second} {
+		req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+		assert.NoError(t, err)
+		assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	}
+
+	if assert.Len(t, f.placementGroups, 1) {
+		assert.Equal(t, hcloud.PlacementGroupTypeSpread, f.placementGroups[0].Type)
+		assert.Len(t, f.placementGroups[0].Servers, 2)
+	}
+
+	// It's only removed once it's empty
+	assert.NoError(t, h.Delete(ctx, first.MachineID))
+	assert.Len(t, f.placementGroups, 1)
+
+	assert.NoError(t, h.Delete(ctx, second.MachineID))
+	assert.Empty(t, f.placementGroups)
+}
+
+func TestCreateExistingPlacementGroup(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	f.placementGroups = []*hcloud.PlacementGroup{{ID: 1, Name: "team", Type: hcloud.PlacementGroupTypeSpread}}
+	h := newTestHetzner(t, f)
+	WithPlacementGroup("team")(h)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, f.placementGroups[0], req.PlacementGroup)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	// Groups not created by the provider are kept
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+	if assert.Len(t, f.placementGroups, 1) {
+		assert.Empty(t, f.placementGroups[0].Servers)
+	}
+}
+
+func TestCreateLabels(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	WithLabels(map[string]string{"team": "payments", "type": "ignored"})(h)
+	WithFirewall(true, nil, nil)(h)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeSnapshot))
+
+	expected := map[string]string{"team": "payments", "type": "devpod", labelMachineID: opts.MachineID}
+	for _, labels := range []map[string]string{
+		req.Labels,
+		f.sshKeys[0].Labels,
+		f.firewalls[0].Labels,
+		f.images[len(f.images)-1].Labels,
+	} {
+		assert.Equal(t, expected, labels)
+	}
+
+	expected[labelVolume] = mainVolumeRole
+	assert.Equal(t, expected, f.volumes[0].Labels)
+}
+
+func TestGenerateUserData(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Extra        string
+		AllowUnknown bool
+		Error        string
+		Assert       func(t *testing.T, config map[string]any)
+	}{
+		{
+			Name: "default",
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Equal(t, []any{"curl", "ufw"}, config["packages"])
+			},
+		},
+		{
+			Name: "merged",
+			Extra: `
+packages:
+  - htop
+write_files:
+  - path: /usr/local/share/ca-certificates/corp.crt
+    content: "{{ .Options.MachineType }}"
+runcmd:
+  - update-ca-certificates
+users:
+  - name: monitoring
+timezone: Europe/London
+`,
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Equal(t, []any{"curl", "ufw", "htop"}, config["packages"])
+				assert.Equal(t, "Europe/London", config["timezone"])
+
+				runcmd := config["runcmd"].([]any)
+				assert.Equal(t, "update-ca-certificates", runcmd[len(runcmd)-1])
+
+				users := config["users"].([]any)
+				if assert.Len(t, users, 2) {
+					assert.Equal(t, SSHUsername, users[0].(map[string]any)["name"])
+					assert.Equal(t, "monitoring", users[1].(map[string]any)["name"])
+				}
+
+				files := config["write_files"].([]any)
+				if assert.Len(t, files, 3) {
+					assert.Equal(t, "cx22", files[2].(map[string]any)["content"])
+				}
+			},
+		},
+		{
+			Name:  "not a mapping",
+			Extra: "- htop",
+			Error: "must be a YAML mapping",
+		},
+		{
+			Name:  "bad template",
+			Extra: "packages: [{{ .Unknown }}]",
+			Error: "invalid CLOUD_INIT_EXTRA",
+		},
+		{
+			Name:  "missing file",
+			Extra: "~/missing.yaml",
+			Error: "invalid CLOUD_INIT_EXTRA: open",
+		},
+		{
+			Name:  "file in home directory",
+			Extra: "~/cloud-init.yaml",
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Contains(t, config["packages"], "htop")
+			},
+		},
+		{
+			Name:  "module keys",
+			Extra: "allow_public_ssh_keys: false\ncloud_final_modules:\n  - scripts-user\n",
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Equal(t, false, config["allow_public_ssh_keys"])
+				assert.Equal(t, []any{"scripts-user"}, config["cloud_final_modules"])
+			},
+		},
+		{
+			Name:         "unknown keys allowed",
+			Extra:        "new_module:\n  enabled: true\n",
+			AllowUnknown: true,
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Equal(t, map[string]any{"enabled": true}, config["new_module"])
+			},
+		},
+		{
+			Name:  "unknown keys",
+			Extra: "new_module:\n  enabled: true\n",
+			Error: `CLOUD_INIT_EXTRA line 1: unknown key "new_module"`,
+		},
+		{
+			Name:  "token isn't available",
+			Extra: "runcmd:\n  - echo '{{ .Options.Token }}'\n",
+			Assert: func(t *testing.T, config map[string]any) {
+				assert.Contains(t, config["runcmd"], "echo ''")
+			},
+		},
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	assert.NoError(t, os.WriteFile(filepath.Join(home, "cloud-init.yaml"), []byte("packages:\n  - htop\n"), 0o600))
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			h := NewHetzner("",
+				WithCloudInit(test.Extra, &options.Options{MachineType: "cx22", Token: "secret-token"}),
+				WithCloudConfigUnknownKeys(test.AllowUnknown),
+			)
+
+			userData, err := h.generateUserData("ssh-ed25519 AAAA\n", 42, nil, nil)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(userData, "#cloud-config\n"))
+			assert.Contains(t, userData, "scsi-0HC_Volume_42")
+			assert.Contains(t, userData, "ssh-ed25519 AAAA")
+
+			var config map[string]any
+			assert.NoError(t, yaml.Unmarshal([]byte(userData), &config))
+			test.Assert(t, config)
+		})
+	}
+}
+
+// writeScripts writes each script to a file, returning their paths
+func writeScripts(t *testing.T, scripts ...string) []string {
+	t.Helper()
+
+	paths := make([]string, 0, len(scripts))
+	for i, script := range scripts {
+		path := filepath.Join(t.TempDir(), fmt.Sprintf("script-%d.sh", i))
+		if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestGenerateUserDataMultipart(t *testing.T) {
+	h := NewHetzner("", WithUserDataParts(
+		writeScripts(t, "#!/bin/bash\necho one\n", "#!/bin/sh\necho two\n"),
+		[]string{"https://example.com/one.yaml", "https://example.com/two.sh"},
+	))
+
+	userData, err := h.generateUserData("ssh-ed25519 AAAA\n", 42, nil, nil)
+	assert.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(userData))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	type part struct {
+		ContentType string
+		Content     string
+	}
+	parts := make([]part, 0)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		content, err := io.ReadAll(p)
+		assert.NoError(t, err)
+		contentType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		parts = append(parts, part{ContentType: contentType, Content: string(content)})
+	}
+
+	if assert.Len(t, parts, 4) {
+		assert.Equal(t, "text/cloud-config", parts[0].ContentType)
+		assert.True(t, strings.HasPrefix(parts[0].Content, "#cloud-config\n"))
+		assert.Contains(t, parts[0].Content, "scsi-0HC_Volume_42")
+
+		assert.Equal(t, part{ContentType: "text/x-shellscript", Content: "#!/bin/bash\necho one\n"}, parts[1])
+		assert.Equal(t, part{ContentType: "text/x-shellscript", Content: "#!/bin/sh\necho two\n"}, parts[2])
+		assert.Equal(t, part{
+			ContentType: "text/x-include-url",
+			Content:     "#include\nhttps://example.com/one.yaml\nhttps://example.com/two.sh\n",
+		}, parts[3])
+	}
+}
+
+func TestRuntimeSetup(t *testing.T) {
+	getDocker := runtimeSetup{Commands: []string{
+		`if docker ; then echo "Docker already installed"; else curl -fsSL https://get.docker.com | sh; fi`,
+		"systemctl restart docker",
+	}}
+
+	tests := []struct {
+		Name     string
+		Runtime  options.ContainerRuntime
+		Image    *hcloud.Image
+		Expected runtimeSetup
+	}{
+		{
+			Name:     "docker app image",
+			Image:    &hcloud.Image{Name: "docker-ce", Type: hcloud.ImageTypeApp, OSFlavor: "ubuntu"},
+			Expected: runtimeSetup{},
+		},
+		{
+			Name:     "snapshot",
+			Image:    &hcloud.Image{Type: hcloud.ImageTypeSnapshot, OSFlavor: "ubuntu"},
+			Expected: runtimeSetup{},
+		},
+		{
+			Name:  "debian",
+			Image: &hcloud.Image{Name: "debian-12", Type: hcloud.ImageTypeSystem, OSFlavor: "debian"},
+			Expected: runtimeSetup{
+				Packages: []string{"docker.io"},
+				Commands: []string{"systemctl enable --now docker"},
+			},
+		},
+		{
+			Name:  "fedora",
+			Image: &hcloud.Image{Name: "fedora-41", Type: hcloud.ImageTypeSystem, OSFlavor: "fedora"},
+			Expected: runtimeSetup{
+				Packages: []string{"moby-engine"},
+				Commands: []string{"systemctl enable --now docker"},
+			},
+		},
+		{
+			Name:  "rocky",
+			Image: &hcloud.Image{Name: "rocky-9", Type: hcloud.ImageTypeSystem, OSFlavor: "rocky"},
+			Expected: runtimeSetup{
+				Packages: []string{"podman", "podman-docker"},
+				Commands: []string{"systemctl enable --now podman.socket"},
+			},
+		},
+		{
+			Name:     "unknown flavour",
+			Image:    &hcloud.Image{Name: "custom", Type: hcloud.ImageTypeSystem, OSFlavor: "unknown"},
+			Expected: getDocker,
+		},
+		{
+			Name:     "explicit",
+			Runtime:  options.ContainerRuntimeGetDocker,
+			Image:    &hcloud.Image{Name: "docker-ce", Type: hcloud.ImageTypeApp, OSFlavor: "ubuntu"},
+			Expected: getDocker,
+		},
+		{
+			Name:     "explicit skip",
+			Runtime:  options.ContainerRuntimeSkip,
+			Image:    &hcloud.Image{Name: "debian-12", Type: hcloud.ImageTypeSystem, OSFlavor: "debian"},
+			Expected: runtimeSetup{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			h := NewHetzner("", WithContainerRuntime(test.Runtime))
+			assert.Equal(t, test.Expected, h.runtimeSetup(test.Image))
+		})
+	}
+}
+
+func TestCreateInvalidUserData(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Extra   string
+		Scripts []string
+		Error   string
+	}{
+		{
+			Name:  "malformed",
+			Extra: "packages: [htop",
+			Error: "CLOUD_INIT_EXTRA: yaml: line 1",
+		},
+		{
+			Name:  "unknown key",
+			Extra: "packages:\n  - htop\npakages:\n  - jq\n",
+			Error: `CLOUD_INIT_EXTRA line 3: unknown key "pakages"`,
+		},
+		{
+			Name:  "wrong type",
+			Extra: "runcmd: echo hello\n",
+			Error: `CLOUD_INIT_EXTRA line 1: "runcmd" must be a list`,
+		},
+		{
+			Name:    "too large",
+			Scripts: []string{"#!/bin/bash\n" + strings.Repeat("#", maxUserDataSize)},
+			Error:   "user-data is too large",
+		},
+		{
+			Name:    "script without shebang",
+			Scripts: []string{"echo hello\n"},
+			Error:   "must start with a shebang",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+			WithCloudInit(test.Extra, &options.Options{})(h)
+			WithFirewall(true, nil, nil)(h)
+			WithPrimaryIPs(true)(h)
+			WithUserDataParts(writeScripts(t, test.Scripts...), nil)(h)
+
+			// Nothing is created if the user-data is invalid
+			_, _, _, err := h.BuildServerOptions(ctx, testOptions(t))
+			assert.ErrorContains(t, err, test.Error)
+			assert.Empty(t, f.sshKeys)
+			assert.Empty(t, f.firewalls)
+			assert.Empty(t, f.primaryIPs)
+			assert.Empty(t, f.volumes)
+			assert.Empty(t, f.servers)
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	// Stopping a non-existent server is a no-op
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeDelete))
+
+	assert.Empty(t, f.servers)
+	assert.Len(t, f.volumes, 1)
+	assert.Nil(t, f.volumes[0].Server)
+
+	status, err := h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusStopped), status)
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+
+	assert.Empty(t, f.servers)
+	assert.Empty(t, f.volumes)
+	assert.Empty(t, f.sshKeys)
+
+	status, err := h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusNotFound), status)
+}
+
+func TestStopKeepsServer(t *testing.T) {
+	for _, mode := range []options.StopMode{options.StopModePowerOff, options.StopModeShutdown} {
+		t.Run(string(mode), func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+			opts := testOptions(t)
+
+			req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+			assert.NoError(t, err)
+			assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+			assert.NoError(t, h.Stop(ctx, opts.MachineID, mode))
+
+			assert.Len(t, f.servers, 1)
+			assert.Equal(t, hcloud.ServerStatusOff, f.servers[0].Status)
+			assert.Equal(t, f.servers[0].ID, f.volumes[0].Server.ID)
+
+			status, err := h.Status(ctx, opts.MachineID)
+			assert.NoError(t, err)
+			assert.Equal(t, client.Status(client.StatusStopped), status)
+
+			started, err := h.Start(ctx, opts.MachineID, 30, privateKey)
+			assert.NoError(t, err)
+			assert.True(t, started)
+			assert.Equal(t, hcloud.ServerStatusRunning, f.servers[0].Status)
+
+			// A running server is not started again
+			started, err = h.Start(ctx, opts.MachineID, 30, privateKey)
+			assert.NoError(t, err)
+			assert.False(t, started)
+		})
+	}
+}
+
+func TestStartKeptServerVolumes(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModePowerOff))
+
+	// Grown when the size increases
+	started, err := h.Start(ctx, opts.MachineID, 50, privateKey)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, 50, f.volumes[0].Size)
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModePowerOff))
+
+	// New volumes can't be mounted on the existing server
+	WithExtraVolumes([]options.ExtraVolume{{Name: "docker", Size: 50, Path: "/var/lib/docker"}})(h)
+	_, err = h.Start(ctx, opts.MachineID, 50, privateKey)
+	assert.EqualError(t, err, ErrVolumeNotOnServer(opts.MachineID+".docker", opts.MachineID).Error())
+	assert.Len(t, f.volumes, 1)
+	assert.Equal(t, hcloud.ServerStatusOff, f.servers[0].Status)
+}
+
+func TestStopSnapshot(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+	opts.StopMode = options.StopModeSnapshot
+
+	snapshots := func() (s []*hcloud.Image) {
+		for _, i := range f.images {
+			if i.Type == hcloud.ImageTypeSnapshot {
+				s = append(s, i)
+			}
+		}
+		return s
+	}
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, opts.DiskImage, req.Image.Name)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeSnapshot))
+	assert.Empty(t, f.servers)
+	assert.Len(t, snapshots(), 1)
+	firstSnapshot := snapshots()[0]
+	assert.Equal(t, opts.MachineID, firstSnapshot.Labels[labelMachineID])
+
+	status, err := h.Status(ctx, opts.MachineID)
+	assert.NoError(t, err)
+	assert.Equal(t, client.Status(client.StatusStopped), status)
+
+	// Start restores from the snapshot, which is deleted once the server is up
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, firstSnapshot.ID, req.Image.ID)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.Empty(t, snapshots())
+
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeSnapshot))
+	assert.Len(t, snapshots(), 1)
+	assert.NotEqual(t, firstSnapshot.ID, snapshots()[0].ID)
+
+	// Snapshots aren't restored once STOP_MODE has changed
+	opts.StopMode = options.StopModeDelete
+	req, _, _, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, opts.DiskImage, req.Image.Name)
+
+	assert.NoError(t, h.Delete(ctx, opts.MachineID))
+	assert.Empty(t, snapshots())
+}
+
+func TestCreateKeepsSnapshotIfProvisioningFails(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+	opts.StopMode = options.StopModeSnapshot
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	assert.NoError(t, h.Stop(ctx, opts.MachineID, options.StopModeSnapshot))
+	images := len(f.images)
+
+	h.connect = func(context.Context, *hcloud.Server, []byte) (*cloudInit, error) {
+		return &cloudInit{Status: "error"}, nil
+	}
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, h.Create(ctx, req, 30, *publicKey, privateKey), ErrCloudInitFailed)
+	assert.Len(t, f.images, images)
+}
+
+func TestCreateResumesExistingServer(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Modify func(f *fakeCloud)
+		Error  error
+	}{
+		{
+			Name: "running",
+		},
+		{
+			Name: "powered off with volume detached",
+			Modify: func(f *fakeCloud) {
+				f.servers[0].Status = hcloud.ServerStatusOff
+				f.volumes[0].Server = nil
+			},
+		},
+		{
+			Name: "deleting",
+			Modify: func(f *fakeCloud) {
+				f.servers[0].Status = hcloud.ServerStatusDeleting
+			},
+			Error: ErrServerDeleting("devpod-test"),
+		},
+		{
+			Name: "volume attached elsewhere",
+			Modify: func(f *fakeCloud) {
+				f.volumes[0].Server = &hcloud.Server{ID: 1}
+			},
+			Error: ErrVolumeAttached("devpod-test", 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFakeCloud()
+			h := newTestHetzner(t, f)
+			opts := testOptions(t)
+
+			req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+			assert.NoError(t, err)
+			assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+			serverID := f.servers[0].ID
+			if test.Modify != nil {
+				test.Modify(f)
+			}
+
+			req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+			assert.NoError(t, err)
+			err = h.Create(ctx, req, 30, *publicKey, privateKey)
+			if test.Error != nil {
+				assert.EqualError(t, err, test.Error.Error())
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, f.servers, 1)
+			assert.Equal(t, serverID, f.servers[0].ID)
+			assert.Equal(t, hcloud.ServerStatusRunning, f.servers[0].Status)
+			assert.Len(t, f.volumes, 1)
+			assert.Equal(t, serverID, f.volumes[0].Server.ID)
+		})
+	}
+}
+
+func TestCreateReplacesFailedServer(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeCloud()
+	h := newTestHetzner(t, f)
+	opts := testOptions(t)
+
+	req, publicKey, privateKey, err := h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+	serverID := f.servers[0].ID
+	volumeID := f.volumes[0].ID
+
+	// cloud-init failed on the existing server, but is fine on a new one
+	h.connect = func(_ context.Context, server *hcloud.Server, _ []byte) (*cloudInit, error) {
+		if server.ID == serverID {
+			return &cloudInit{Status: "error", Diagnostics: "status: error"}, nil
+		}
+		return &cloudInit{Status: "done"}, nil
+	}
+
+	req, publicKey, privateKey, err = h.BuildServerOptions(ctx, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Create(ctx, req, 30, *publicKey, privateKey))
+
+	if assert.Len(t, f.servers, 1) {
+		assert.NotEqual(t, serverID, f.servers[0].ID)
+	}
+	if assert.Len(t, f.volumes, 1) {
+		assert.Equal(t, volumeID, f.volumes[0].ID)
+		assert.Equal(t, f.servers[0].ID, f.volumes[0].Server.ID)
+	}
+}
+
+// tarball creates a compressed tarball of empty entries
+func tarball(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range headers {
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+
+	return buf.Bytes()
+}
+
+func TestCheckArchive(t *testing.T) {
+	paths := []string{"./home/devpod", "./var/lib/docker"}
+
+	tests := []struct {
+		Name    string
+		Archive []byte
+		Error   string
+	}{
+		{
+			Name: "volumes",
+			Archive: tarball(t,
+				&tar.Header{Name: "./home/devpod/", Typeflag: tar.TypeDir},
+				&tar.Header{Name: "./home/devpod/.bashrc"},
+				&tar.Header{Name: "./home/devpod/link", Typeflag: tar.TypeLink, Linkname: "./home/devpod/.bashrc"},
+				&tar.Header{Name: "./home/devpod/go", Typeflag: tar.TypeSymlink, Linkname: "/usr/local/go"},
+				&tar.Header{Name: "./var/lib/docker/volumes/data"},
+			),
+		},
+		{
+			Name:    "empty",
+			Archive: tarball(t),
+		},
+		{
+			Name:    "outside the volumes",
+			Archive: tarball(t, &tar.Header{Name: "./home/devpod/.bashrc"}, &tar.Header{Name: "./etc/passwd"}),
+			Error:   "./etc/passwd is outside the workspace's volumes",
+		},
+		{
+			Name:    "sibling of a volume",
+			Archive: tarball(t, &tar.Header{Name: "./home/devpod2/.bashrc"}),
+			Error:   "./home/devpod2/.bashrc is outside",
+		},
+		{
+			Name:    "absolute",
+			Archive: tarball(t, &tar.Header{Name: "/home/devpod/.bashrc"}),
+			Error:   "/home/devpod/.bashrc is outside",
+		},
+		{
+			Name:    "parent directory",
+			Archive: tarball(t, &tar.Header{Name: "./home/devpod/../../etc/passwd"}),
+			Error:   "./home/devpod/../../etc/passwd is outside",
+		},
+		{
+			Name:    "hard link outside the volumes",
+			Archive: tarball(t, &tar.Header{Name: "./home/devpod/shadow", Typeflag: tar.TypeLink, Linkname: "./etc/shadow"}),
+			Error:   "./etc/shadow is outside",
+		},
+		{
+			Name: "through a symlink",
+			Archive: tarball(t,
+				&tar.Header{Name: "./home/devpod/etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				&tar.Header{Name: "./home/devpod/etc/passwd"},
+			),
+			Error: "./home/devpod/etc/passwd is outside",
+		},
+		{
+			Name:    "not compressed",
+			Archive: []byte("not a gzipped tarball"),
+			Error:   "invalid backup: gzip: invalid header",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := checkArchive(bytes.NewReader(test.Archive), paths)
+			if test.Error == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidBackup)
+			assert.ErrorContains(t, err, test.Error)
+		})
+	}
+}
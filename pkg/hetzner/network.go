@@ -0,0 +1,116 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+)
+
+// privateNetwork finds the configured private network, returning nil if the
+// servers don't join one
+func (h *Hetzner) privateNetwork(ctx context.Context) (*hcloud.Network, error) {
+	if h.network == "" {
+		return nil, nil
+	}
+
+	network, _, err := h.client.Network.Get(ctx, h.network)
+	if err != nil {
+		return nil, err
+	}
+	if network == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownNetwork, h.network)
+	}
+
+	return network, nil
+}
+
+// configureNetwork adds the public and private networks to the server create
+// options. The API can't set the IP when creating a server, so if one is
+// configured the server is created powered off and joined to the network by
+// joinNetwork.
+func (h *Hetzner) configureNetwork(ctx context.Context, req *hcloud.ServerCreateOpts) error {
+	if !h.publicIPv4 || !h.publicIPv6 {
+		req.PublicNet = &hcloud.ServerCreatePublicNet{
+			EnableIPv4: h.publicIPv4,
+			EnableIPv6: h.publicIPv6,
+		}
+	}
+
+	network, err := h.privateNetwork(ctx)
+	if err != nil || network == nil {
+		return err
+	}
+
+	if h.networkIP != nil {
+		req.StartAfterCreate = hcloud.Ptr(false)
+		return nil
+	}
+
+	req.Networks = []*hcloud.Network{network}
+
+	return nil
+}
+
+// joinNetwork attaches a newly created server to the private network with the
+// configured IP and powers it on. The server is returned with its private
+// network details populated.
+func (h *Hetzner) joinNetwork(ctx context.Context, server *hcloud.Server) (*hcloud.Server, error) {
+	if h.network == "" {
+		return server, nil
+	}
+
+	if h.networkIP != nil {
+		network, err := h.privateNetwork(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Default.Infof("Attaching server to network %s with IP %s", network.Name, h.networkIP)
+
+		action, _, err := h.client.Server.AttachToNetwork(ctx, server, hcloud.ServerAttachToNetworkOpts{
+			Network: network,
+			IP:      h.networkIP,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := h.client.Action.Wait(ctx, action); err != nil {
+			log.Default.Errorf("Error in network attach action: %s", err)
+			return nil, err
+		}
+
+		if err := h.powerOn(ctx, server); err != nil {
+			return nil, err
+		}
+	}
+
+	// The private IP is only known once the server has joined the network
+	updated, _, err := h.client.Server.GetByName(ctx, server.Name)
+	if err != nil {
+		return nil, err
+	}
+	if updated == nil {
+		return nil, fmt.Errorf("server %s not found after joining network", server.Name)
+	}
+
+	return updated, nil
+}
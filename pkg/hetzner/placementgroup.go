@@ -0,0 +1,90 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+)
+
+// upsertPlacementGroup finds the configured placement group, creating a
+// spread group if it doesn't exist. It returns nil if no group is configured.
+func (h *Hetzner) upsertPlacementGroup(ctx context.Context) (*hcloud.PlacementGroup, error) {
+	if h.placementGroup == "" {
+		return nil, nil
+	}
+
+	placementGroup, _, err := h.client.PlacementGroup.Get(ctx, h.placementGroup)
+	if err != nil {
+		return nil, err
+	}
+	if placementGroup != nil {
+		log.Default.Infof("Using placement group: %s", placementGroup.Name)
+		return placementGroup, nil
+	}
+
+	log.Default.Infof("Creating placement group: %s", h.placementGroup)
+
+	result, _, err := h.client.PlacementGroup.Create(ctx, hcloud.PlacementGroupCreateOpts{
+		Name: h.placementGroup,
+		Type: hcloud.PlacementGroupTypeSpread,
+		// Shared between workspaces, so it has no machine ID
+		Labels: h.resourceLabels(""),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.record(fmt.Sprintf("placement group %s", h.placementGroup), func(ctx context.Context) error {
+		_, err := h.client.PlacementGroup.Delete(ctx, result.PlacementGroup)
+		return err
+	})
+
+	if result.Action != nil {
+		if err := h.client.Action.Wait(ctx, result.Action); err != nil {
+			log.Default.Errorf("Error in placement group creation action: %s", err)
+			return nil, err
+		}
+	}
+
+	return result.PlacementGroup, nil
+}
+
+// deleteEmptyPlacementGroup removes a placement group created by the provider
+// once it has no servers left in it
+func (h *Hetzner) deleteEmptyPlacementGroup(ctx context.Context, idOrName string) error {
+	if idOrName == "" {
+		return nil
+	}
+
+	placementGroup, _, err := h.client.PlacementGroup.Get(ctx, idOrName)
+	if err != nil {
+		return err
+	}
+	if placementGroup == nil || placementGroup.Labels["type"] != "devpod" || len(placementGroup.Servers) > 0 {
+		return nil
+	}
+
+	log.Default.Infof("Deleting empty placement group: %s", placementGroup.Name)
+
+	_, err = h.client.PlacementGroup.Delete(ctx, placementGroup)
+
+	return err
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+)
+
+// assignPrimaryIPs adds the workspace's Primary IPs to the server create
+// options, creating them the first time. They outlive the server, so it keeps
+// the same public IPs across stop and start.
+func (h *Hetzner) assignPrimaryIPs(ctx context.Context, req *hcloud.ServerCreateOpts) error {
+	if !h.primaryIPs {
+		return nil
+	}
+
+	existing, err := h.primaryIPsByMachineID(ctx, req.Name)
+	if err != nil {
+		return err
+	}
+
+	publicNet := &hcloud.ServerCreatePublicNet{
+		EnableIPv4: h.publicIPv4,
+		EnableIPv6: h.publicIPv6,
+	}
+
+	for _, ipType := range []hcloud.PrimaryIPType{hcloud.PrimaryIPTypeIPv4, hcloud.PrimaryIPTypeIPv6} {
+		if (ipType == hcloud.PrimaryIPTypeIPv4 && !h.publicIPv4) || (ipType == hcloud.PrimaryIPTypeIPv6 && !h.publicIPv6) {
+			continue
+		}
+
+		var primaryIP *hcloud.PrimaryIP
+		for _, ip := range existing {
+			if ip.Type == ipType {
+				primaryIP = ip
+				break
+			}
+		}
+
+		if primaryIP == nil {
+			if primaryIP, err = h.createPrimaryIP(ctx, req, ipType); err != nil {
+				return err
+			}
+		}
+
+		if ipType == hcloud.PrimaryIPTypeIPv4 {
+			publicNet.IPv4 = primaryIP
+		} else {
+			publicNet.IPv6 = primaryIP
+		}
+	}
+
+	req.PublicNet = publicNet
+
+	return nil
+}
+
+func (h *Hetzner) createPrimaryIP(
+	ctx context.Context,
+	req *hcloud.ServerCreateOpts,
+	ipType hcloud.PrimaryIPType,
+) (*hcloud.PrimaryIP, error) {
+	// Primary IPs belong to a datacenter rather than a location
+	datacenter, err := h.datacenter(ctx, req.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s", req.Name, ipType)
+
+	log.Default.Infof("Creating primary IP: %s", name)
+
+	result, _, err := h.client.PrimaryIP.Create(ctx, hcloud.PrimaryIPCreateOpts{
+		Name:         name,
+		Type:         ipType,
+		AssigneeType: "server",
+		AutoDelete:   hcloud.Ptr(false),
+		Datacenter:   datacenter.Name,
+		Labels:       h.resourceLabels(req.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.record(fmt.Sprintf("primary IP %s", name), func(ctx context.Context) error {
+		_, err := h.client.PrimaryIP.Delete(ctx, result.PrimaryIP)
+		return err
+	})
+
+	if result.Action != nil {
+		if err := h.client.Action.Wait(ctx, result.Action); err != nil {
+			log.Default.Errorf("Error in primary IP creation action: %s", err)
+			return nil, err
+		}
+	}
+
+	return result.PrimaryIP, nil
+}
+
+// datacenter finds a datacenter in the location
+func (h *Hetzner) datacenter(ctx context.Context, location *hcloud.Location) (*hcloud.Datacenter, error) {
+	datacenters, _, err := h.client.Datacenter.List(ctx, hcloud.DatacenterListOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dc := range datacenters {
+		if dc.Location != nil && dc.Location.Name == location.Name {
+			return dc, nil
+		}
+	}
+
+	return nil, ErrNoDatacenter(location.Name)
+}
+
+// deletePrimaryIPs releases the workspace's Primary IPs. They can only be
+// deleted once they're no longer assigned to the server.
+func (h *Hetzner) deletePrimaryIPs(ctx context.Context, name string) error {
+	primaryIPs, err := h.primaryIPsByMachineID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range primaryIPs {
+		log.Default.Infof("Releasing primary IP: %s", ip.IP)
+
+		if _, err := h.client.PrimaryIP.Delete(ctx, ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *Hetzner) primaryIPsByMachineID(ctx context.Context, machineID string) ([]*hcloud.PrimaryIP, error) {
+	primaryIPs, _, err := h.client.PrimaryIP.List(ctx, hcloud.PrimaryIPListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMachineID, machineID),
+		},
+	})
+
+	return primaryIPs, err
+}
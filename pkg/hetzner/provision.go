@@ -0,0 +1,198 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/loft-sh/log"
+)
+
+const (
+	// cloudInitStatusCommand reports the status. The long format includes the
+	// extended status, which is how newer versions report a degraded boot.
+	cloudInitStatusCommand = "cloud-init status --long || true"
+	cloudInitLogFile       = "/var/log/cloud-init-output.log"
+)
+
+type cloudInit struct {
+	Status         string
+	ExtendedStatus string
+
+	// Diagnostics is the cloud-init status and the end of its log, collected
+	// once cloud-init has failed
+	Diagnostics string
+}
+
+// failed reports whether cloud-init has stopped in a state that waiting
+// longer won't fix
+func (c *cloudInit) failed() bool {
+	return c.Status == "error" || c.Status == "degraded" || strings.HasPrefix(c.ExtendedStatus, "degraded")
+}
+
+// provisionFailed reports whether cloud-init has already failed on a running
+// server. If its status can't be checked yet, eg while it's booting, it's
+// treated as healthy and left to waitForProvisioning.
+func (h *Hetzner) provisionFailed(ctx context.Context, server *hcloud.Server, privateKeyFile []byte) bool {
+	if server.Status != hcloud.ServerStatusRunning {
+		return false
+	}
+
+	status, err := h.connect(ctx, server, privateKeyFile)
+	if err != nil {
+		log.Default.Debugf("Unable to check server provision status: %v", err)
+		return false
+	}
+	if !status.failed() {
+		return false
+	}
+
+	log.Default.Warnf("%s on server %s with status %s:\n%s", ErrCloudInitFailed, server.Name, status.Status, status.Diagnostics)
+	return true
+}
+
+// waitForProvisioning polls the server until cloud-init has finished. Failed
+// checks are retried with exponential backoff until the provision timeout
+// has elapsed or the context is cancelled.
+func (h *Hetzner) waitForProvisioning(ctx context.Context, server *hcloud.Server, privateKeyFile []byte) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, h.provisionTimeout, ErrProvisionTimeout)
+	defer cancel()
+
+	var lastStatus string
+	var lastErr error
+	delay := provisionInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		log.Default.Debugf("Checking server provision status, attempt %d", attempt)
+
+		status, err := h.connect(ctx, server, privateKeyFile)
+		if err != nil {
+			log.Default.Debugf("Unable to check server provision status: %v", err)
+			lastErr = err
+		} else {
+			if status.failed() {
+				return fmt.Errorf("%w on server %s with status %s:\n%s", ErrCloudInitFailed, server.Name, status.Status, status.Diagnostics)
+			}
+
+			if status.Status == "done" {
+				// The server is ready
+				return nil
+			}
+
+			log.Default.Debugf("Server not yet provisioned: %s", status.Status)
+			lastStatus = status.Status
+		}
+
+		select {
+		case <-ctx.Done():
+			return provisionError(context.Cause(ctx), attempt, lastStatus, lastErr)
+		case <-time.After(jitter(delay)):
+		}
+
+		delay = min(delay*2, provisionMaxBackoff)
+	}
+}
+
+// provisionError reports the last thing seen before giving up on the server
+func provisionError(cause error, attempts int, lastStatus string, lastErr error) error {
+	if lastStatus == "" {
+		lastStatus = "unknown"
+	}
+
+	sshErr := "none"
+	if lastErr != nil {
+		sshErr = lastErr.Error()
+	}
+
+	return fmt.Errorf("%w after %d attempts - last cloud-init status: %s, last SSH error: %s", cause, attempts, lastStatus, sshErr)
+}
+
+// jitter returns a random duration between half and all of d, so
+// simultaneous creates don't poll in lockstep
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half) //nolint:gosec // doesn't need to be cryptographically secure
+}
+
+func (h *Hetzner) attemptConnection(ctx context.Context, server *hcloud.Server, privateKeyFile []byte) (*cloudInit, error) {
+	sshClient, err := h.SSHClient(server, privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to server: %w", err)
+	}
+	defer func() {
+		_ = sshClient.Close()
+	}()
+
+	buf := new(bytes.Buffer)
+	if err := ssh.Run(ctx, sshClient, cloudInitStatusCommand, &bytes.Buffer{}, buf, &bytes.Buffer{}, nil); err != nil {
+		return nil, fmt.Errorf("error retrieving cloud-init status: %w", err)
+	}
+
+	status, err := parseCloudInitStatus(buf.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if status.failed() {
+		// Grab the log while we've got a connection so the user doesn't have to
+		logs := new(bytes.Buffer)
+		cmd := fmt.Sprintf("sudo -n tail -n %d %s", cloudInitLogLines, cloudInitLogFile)
+		if err := ssh.Run(ctx, sshClient, cmd, &bytes.Buffer{}, logs, logs, nil); err != nil {
+			fmt.Fprintf(logs, "unable to read %s: %v\n", cloudInitLogFile, err)
+		}
+
+		status.Diagnostics = fmt.Sprintf("%s\n==> %s <==\n%s", strings.TrimSpace(buf.String()), cloudInitLogFile, logs)
+	}
+
+	return status, nil
+}
+
+// parseCloudInitStatus reads the output of "cloud-init status --long". This is
+// parsed line by line as older versions don't output valid YAML.
+func parseCloudInitStatus(output string) (*cloudInit, error) {
+	status := &cloudInit{}
+
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "status":
+			status.Status = strings.TrimSpace(value)
+		case "extended_status":
+			status.ExtendedStatus = strings.TrimSpace(value)
+		}
+	}
+
+	if status.Status == "" {
+		return nil, fmt.Errorf("unable to parse cloud-init status: %q", output)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/loft-sh/log"
+)
+
+type rollbackStep struct {
+	resource string
+	undo     func(ctx context.Context) error
+}
+
+// transaction records each resource created while creating a workspace so
+// they can be torn down if a later step fails. Resources which already
+// existed, such as a volume kept by a previous stop, are never recorded.
+type transaction struct {
+	steps []rollbackStep
+}
+
+func (t *transaction) record(resource string, undo func(ctx context.Context) error) {
+	t.steps = append(t.steps, rollbackStep{
+		resource: resource,
+		undo:     undo,
+	})
+}
+
+// rollback undoes the steps in the reverse order to which they were recorded
+func (t *transaction) rollback(ctx context.Context) error {
+	var errs []error
+
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+
+		log.Default.Infof("Rolling back %s", step.resource)
+		if err := step.undo(ctx); err != nil {
+			log.Default.Errorf("Error rolling back %s: %s", step.resource, err)
+			errs = append(errs, fmt.Errorf("%s: %w", step.resource, err))
+		}
+	}
+
+	t.steps = nil
+
+	return errors.Join(errs...)
+}
+
+// record adds a created resource to the current transaction
+func (h *Hetzner) record(resource string, undo func(ctx context.Context) error) {
+	if h.tx == nil {
+		h.tx = &transaction{}
+	}
+	h.tx.record(resource, undo)
+}
+
+// rollbackOnError tears down the resources created in the current transaction
+// if *err is set. It is designed to be deferred.
+func (h *Hetzner) rollbackOnError(ctx context.Context, err *error) {
+	if *err == nil || h.tx == nil || len(h.tx.steps) == 0 {
+		return
+	}
+
+	if !h.rollback {
+		for _, step := range h.tx.steps {
+			log.Default.Warnf("Rollback disabled - leaving %s in place", step.resource)
+		}
+		h.tx = nil
+		return
+	}
+
+	log.Default.Warnf("Creation failed - removing created resources: %s", *err)
+
+	// Still clean up if the failure was caused by the context being cancelled
+	if rollbackErr := h.tx.rollback(context.WithoutCancel(ctx)); rollbackErr != nil {
+		*err = fmt.Errorf("%w (rollback failed: %w)", *err, rollbackErr)
+	}
+	h.tx = nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+)
+
+// dockerAppImage is Hetzner's app image with Docker preinstalled
+const dockerAppImage = "docker-ce"
+
+// runtimeSetup is how cloud-init installs the container runtime
+type runtimeSetup struct {
+	Packages []string
+	Commands []string
+}
+
+// runtimeSetup returns the packages and commands that install the container
+// runtime on a server created from the image
+func (h *Hetzner) runtimeSetup(image *hcloud.Image) runtimeSetup {
+	runtime := h.containerRuntime
+	if runtime == "" {
+		runtime = defaultContainerRuntime(image)
+	}
+
+	osFlavor := ""
+	if image != nil {
+		osFlavor = image.OSFlavor
+	}
+
+	switch runtime {
+	case options.ContainerRuntimeSkip:
+		return runtimeSetup{}
+	case options.ContainerRuntimeDistroPackage:
+		return runtimeSetup{
+			Packages: []string{dockerPackage(osFlavor)},
+			Commands: []string{"systemctl enable --now docker"},
+		}
+	case options.ContainerRuntimePodman:
+		return runtimeSetup{
+			Packages: []string{"podman", "podman-docker"},
+			Commands: []string{"systemctl enable --now podman.socket"},
+		}
+	default:
+		return runtimeSetup{
+			Commands: []string{
+				`if docker ; then echo "Docker already installed"; else curl -fsSL https://get.docker.com | sh; fi`,
+				"systemctl restart docker",
+			},
+		}
+	}
+}
+
+// defaultContainerRuntime chooses how to install the container runtime from
+// the image. Nothing is installed if it's already there, otherwise the OS's
+// own packages are preferred to running a script from the internet.
+func defaultContainerRuntime(image *hcloud.Image) options.ContainerRuntime {
+	if image == nil {
+		return options.ContainerRuntimeGetDocker
+	}
+
+	if image.Type == hcloud.ImageTypeSnapshot || (image.Type == hcloud.ImageTypeApp && image.Name == dockerAppImage) {
+		// Snapshots are of workspaces, which already have a runtime
+		return options.ContainerRuntimeSkip
+	}
+
+	switch image.OSFlavor {
+	case "debian", "fedora", "ubuntu":
+		return options.ContainerRuntimeDistroPackage
+	case "alma", "centos", "rocky":
+		// Docker isn't packaged for the RHEL family
+		return options.ContainerRuntimePodman
+	default:
+		return options.ContainerRuntimeGetDocker
+	}
+}
+
+// dockerPackage is the name of the OS's Docker package
+func dockerPackage(osFlavor string) string {
+	switch osFlavor {
+	case "debian", "ubuntu":
+		return "docker.io"
+	case "fedora":
+		return "moby-engine"
+	default:
+		return "docker"
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+	"github.com/pkg/errors"
+)
+
+// snapshot shuts the server down, saves it as a labelled snapshot and then
+// deletes it. Older snapshots of the same machine are pruned once the new one
+// is available.
+func (h *Hetzner) snapshot(ctx context.Context, server *hcloud.Server) error {
+	// Stop writes so the snapshot is consistent
+	if err := h.shutdown(ctx, server); err != nil {
+		return err
+	}
+
+	log.Default.Info("Creating server snapshot")
+
+	result, _, err := h.client.Server.CreateImage(ctx, server, &hcloud.ServerCreateImageOpts{
+		Type:        hcloud.ImageTypeSnapshot,
+		Description: hcloud.Ptr(fmt.Sprintf("DevPod %s %s", server.Name, time.Now().UTC().Format(time.RFC3339))),
+		Labels:      h.resourceLabels(server.Name),
+	})
+	if err != nil {
+		return errors.Wrap(err, "create snapshot")
+	}
+
+	if err := h.client.SnapshotAction.Wait(ctx, result.Action); err != nil {
+		log.Default.Errorf("Error in snapshot creation action: %s", err)
+		return err
+	}
+
+	log.Default.Infof("Snapshot %d created", result.Image.ID)
+
+	if err := h.pruneSnapshots(ctx, server.Name, result.Image.ID); err != nil {
+		return err
+	}
+
+	deleteResult, _, err := h.client.Server.DeleteWithResult(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	return h.client.Action.Wait(ctx, deleteResult.Action)
+}
+
+// latestSnapshot returns the newest snapshot of the machine for the given
+// architecture, or nil if there isn't one
+func (h *Hetzner) latestSnapshot(ctx context.Context, name string, arch hcloud.Architecture) (*hcloud.Image, error) {
+	snapshots, err := h.listSnapshots(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range snapshots {
+		if s.Architecture == arch && s.Status == hcloud.ImageStatusAvailable {
+			return s, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// listSnapshots returns the machine's snapshots, newest first
+func (h *Hetzner) listSnapshots(ctx context.Context, name string) ([]*hcloud.Image, error) {
+	snapshots, _, err := h.client.Image.List(ctx, hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMachineID, name),
+		},
+		Type: []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(snapshots, func(a, b *hcloud.Image) int {
+		return b.Created.Compare(a.Created)
+	})
+
+	return snapshots, nil
+}
+
+// pruneSnapshots deletes all of the machine's snapshots except keepID
+func (h *Hetzner) pruneSnapshots(ctx context.Context, name string, keepID int64) error {
+	snapshots, err := h.listSnapshots(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range snapshots {
+		if s.ID == keepID {
+			continue
+		}
+
+		log.Default.Infof("Deleting snapshot: %d", s.ID)
+		if _, err := h.client.Image.Delete(ctx, s); err != nil {
+			return errors.Wrap(err, "delete snapshot")
+		}
+	}
+
+	return nil
+}
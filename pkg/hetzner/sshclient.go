@@ -0,0 +1,136 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/devpod/pkg/ssh"
+	"github.com/mrsimonemms/devpod-provider-hetzner/pkg/options"
+	cryptoSsh "golang.org/x/crypto/ssh"
+)
+
+// jumpHost is an SSH server used to reach servers without a public IP
+type jumpHost struct {
+	user           string
+	address        string
+	privateKeyFile string
+}
+
+// SSHAddress returns the host and port used to connect to the server, using
+// the first address in the preference order that the server has
+func (h *Hetzner) SSHAddress(server *hcloud.Server) (string, error) {
+	for _, addressType := range h.addressPreference {
+		if ip := serverIP(server, addressType); ip != nil {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(h.sshPort)), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s has no %s address", ErrNoServerAddress, server.Name, joinAddressTypes(h.addressPreference))
+}
+
+// serverIP returns the server's IP of the given type, or nil if it has none
+func serverIP(server *hcloud.Server, addressType options.AddressType) net.IP {
+	switch addressType {
+	case options.AddressIPv4:
+		if !server.PublicNet.IPv4.IsUnspecified() {
+			return server.PublicNet.IPv4.IP
+		}
+	case options.AddressIPv6:
+		// Servers are given a /64 and configured with its first address
+		if network := server.PublicNet.IPv6.Network; network != nil {
+			ip := slices.Clone(network.IP.To16())
+			ip[len(ip)-1] |= 1
+			return ip
+		}
+	case options.AddressPrivate:
+		if len(server.PrivateNet) > 0 {
+			return server.PrivateNet[0].IP
+		}
+	}
+	return nil
+}
+
+func joinAddressTypes(types []options.AddressType) string {
+	s := make([]string, 0, len(types))
+	for _, t := range types {
+		s = append(s, string(t))
+	}
+	return strings.Join(s, ", ")
+}
+
+// SSHClient connects to the server as the DevPod user, through the jump host
+// if one is configured
+func (h *Hetzner) SSHClient(server *hcloud.Server, privateKeyFile []byte) (*cryptoSsh.Client, error) {
+	addr, err := h.SSHAddress(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.jumpHost == nil {
+		return ssh.NewSSHClient(SSHUsername, addr, privateKeyFile)
+	}
+
+	jumpKey := privateKeyFile
+	if h.jumpHost.privateKeyFile != "" {
+		if jumpKey, err = os.ReadFile(h.jumpHost.privateKeyFile); err != nil {
+			return nil, fmt.Errorf("load jump host private key: %w", err)
+		}
+	}
+
+	jump, err := ssh.NewSSHClient(h.jumpHost.user, h.jumpHost.address, jumpKey)
+	if err != nil {
+		return nil, fmt.Errorf("connect to jump host: %w", err)
+	}
+
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		_ = jump.Close()
+		return nil, fmt.Errorf("dial %s through jump host: %w", addr, err)
+	}
+
+	config, err := ssh.ConfigFromKeyBytes(privateKeyFile)
+	if err != nil {
+		_ = conn.Close()
+		_ = jump.Close()
+		return nil, err
+	}
+	config.User = SSHUsername
+
+	c, chans, reqs, err := cryptoSsh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = conn.Close()
+		_ = jump.Close()
+		return nil, fmt.Errorf("connect to %s through jump host: %w", addr, err)
+	}
+
+	client := cryptoSsh.NewClient(c, chans, reqs)
+
+	// The jump host connection is only needed for as long as the client
+	go func() {
+		_ = client.Wait()
+		_ = jump.Close()
+	}()
+
+	return client, nil
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hetzner
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/loft-sh/log"
+	"github.com/pkg/errors"
+)
+
+// volumeMount is how the workspace's volume is formatted and mounted
+type volumeMount struct {
+	Filesystem string
+	MountPath  string
+	Options    string
+}
+
+// defaultVolumeMount is an ext4 volume mounted as the user's home directory
+var defaultVolumeMount = volumeMount{
+	Filesystem: "ext4",
+	MountPath:  "/home/" + SSHUsername,
+	Options:    "discard,nofail,defaults",
+}
+
+// checkVolumeFilesystem makes sure an existing volume is formatted as the
+// filesystem it'll be mounted as. Volumes can't be reformatted without
+// losing their data.
+func (h *Hetzner) checkVolumeFilesystem(volume *hcloud.Volume) error {
+	if volume.Format != nil && *volume.Format != h.volume.Filesystem {
+		return ErrVolumeFilesystem(volume.Name, *volume.Format, h.volume.Filesystem)
+	}
+	return nil
+}
+
+// extraVolumeMount is where an extra volume is mounted
+type extraVolumeMount struct {
+	ID   string
+	Path string
+}
+
+// mainVolumeRole labels the workspace's volume, which is named after the
+// machine. Volumes created before roles were labelled have no role.
+const mainVolumeRole = "main"
+
+// extraVolumeRole labels an extra volume with its configured name
+func extraVolumeRole(name string) string {
+	return "extra-" + name
+}
+
+// extraVolumeName is the name of an extra volume. Machine IDs and extra
+// volume names can't contain a dot, so it can't match another workspace's
+// volume names.
+func extraVolumeName(machineID, name string) string {
+	return machineID + "." + name
+}
+
+// upsertExtraVolumes creates or grows the workspace's extra volumes, returning
+// them in the order they're configured
+func (h *Hetzner) upsertExtraVolumes(ctx context.Context, req *hcloud.ServerCreateOpts) ([]*hcloud.Volume, error) {
+	volumes := make([]*hcloud.Volume, 0, len(h.extraVolumes))
+	for _, extra := range h.extraVolumes {
+		volume, err := h.upsertVolume(ctx, req, extraVolumeName(req.Name, extra.Name), extraVolumeRole(extra.Name), extra.Size)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// upsertVolume creates the machine's volume with the role, or grows the
+// existing one if the size has increased
+func (h *Hetzner) upsertVolume(ctx context.Context, req *hcloud.ServerCreateOpts, name, role string, size int) (*hcloud.Volume, error) {
+	volume, err := h.machineVolume(ctx, req.Name, role)
+	if err != nil {
+		return nil, err
+	}
+
+	if volume != nil {
+		if err := h.checkVolumeFilesystem(volume); err != nil {
+			return nil, err
+		}
+		if err := h.resizeVolume(ctx, volume, size); err != nil {
+			return nil, err
+		}
+		return volume, nil
+	}
+
+	// Create the volume as it doesn't exist
+	log.Default.Infof("Creating a new volume: %s", name)
+
+	labels := maps.Clone(req.Labels)
+	labels[labelVolume] = role
+
+	result, _, err := h.client.Volume.Create(ctx, hcloud.VolumeCreateOpts{
+		Location:  req.Location,
+		Name:      name,
+		Size:      size,
+		Format:    hcloud.Ptr(h.volume.Filesystem),
+		Automount: hcloud.Ptr(false),
+		Labels:    labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.record(fmt.Sprintf("volume %s", name), func(ctx context.Context) error {
+		return h.deleteVolume(ctx, result.Volume)
+	})
+
+	if err := h.client.Action.Wait(ctx, result.Action, result.NextActions...); err != nil {
+		log.Default.Errorf("Error in volume creation action: %s", err)
+		return nil, err
+	}
+
+	log.Default.Info("Volume successfully created")
+
+	return result.Volume, nil
+}
+
+// keptVolumes returns the volumes of an existing server, grown to their
+// configured sizes. The filesystems are grown when the server next boots.
+// Volumes can't be added to an existing server as the cloud-config that
+// mounts them only runs when it's created.
+func (h *Hetzner) keptVolumes(ctx context.Context, machineID string, diskSize int) ([]*hcloud.Volume, error) {
+	type wanted struct {
+		name string
+		role string
+		size int
+	}
+
+	all := make([]wanted, 0, len(h.extraVolumes)+1)
+	if h.persistentVolume {
+		all = append(all, wanted{name: machineID, role: mainVolumeRole, size: diskSize})
+	}
+	for _, extra := range h.extraVolumes {
+		all = append(all, wanted{name: extraVolumeName(machineID, extra.Name), role: extraVolumeRole(extra.Name), size: extra.Size})
+	}
+
+	volumes := make([]*hcloud.Volume, 0, len(all))
+	for _, w := range all {
+		volume, err := h.machineVolume(ctx, machineID, w.role)
+		if err != nil {
+			return nil, err
+		} else if volume == nil {
+			return nil, ErrVolumeNotOnServer(w.name, machineID)
+		}
+
+		if err := h.checkVolumeFilesystem(volume); err != nil {
+			return nil, err
+		}
+		if err := h.resizeVolume(ctx, volume, w.size); err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, volume)
+	}
+
+	return volumes, nil
+}
+
+// attachVolume attaches the volume to the server if it isn't already
+func (h *Hetzner) attachVolume(ctx context.Context, volume *hcloud.Volume, server *hcloud.Server) error {
+	if volume.Server != nil {
+		if volume.Server.ID != server.ID {
+			return ErrVolumeAttached(volume.Name, volume.Server.ID)
+		}
+		return nil
+	}
+
+	log.Default.Info("Attaching volume to server")
+
+	action, _, err := h.client.Volume.Attach(ctx, volume, server)
+	if err != nil {
+		return errors.Wrap(err, "attach volume")
+	}
+
+	if err := h.client.Action.Wait(ctx, action); err != nil {
+		log.Default.Errorf("Error in volume attach action: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// deleteMachineVolumes deletes the volumes labelled with the machine ID, such
+// as its extra volumes
+func (h *Hetzner) deleteMachineVolumes(ctx context.Context, machineID string) error {
+	volumes, err := h.volumesByMachineID(ctx, machineID)
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range volumes {
+		log.Default.Infof("Deleting volume: %s", volume.Name)
+		if err := h.deleteVolume(ctx, volume); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// volumesByMachineID finds the volumes created for the machine by their label
+func (h *Hetzner) volumesByMachineID(ctx context.Context, machineID string) ([]*hcloud.Volume, error) {
+	volumes, _, err := h.client.Volume.List(ctx, hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMachineID, machineID),
+		},
+	})
+	return volumes, err
+}
+
+// machineVolume finds the machine's volume with the role. Only volumes
+// labelled with the machine ID are considered, so another workspace's
+// volumes are never used.
+func (h *Hetzner) machineVolume(ctx context.Context, machineID, role string) (*hcloud.Volume, error) {
+	volumes, err := h.volumesByMachineID(ctx, machineID)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *hcloud.Volume
+	for _, volume := range volumes {
+		volumeRole, ok := volume.Labels[labelVolume]
+		if !ok && volume.Name == machineID {
+			volumeRole = mainVolumeRole
+		}
+		if volumeRole != role {
+			continue
+		}
+
+		if found != nil {
+			return nil, ErrMultipleVolumesFound(machineID, role)
+		}
+		found = volume
+	}
+
+	return found, nil
+}
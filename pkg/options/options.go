@@ -18,19 +18,127 @@ package options
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// extraVolumeName is the name of an extra volume, which is appended to the
+// machine ID to give the volume's name and used in its role label. Label
+// values are up to 63 characters and start and end with a letter or number.
+var extraVolumeName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,55}[a-zA-Z0-9])?$`)
+
+// minVolumeSize is the smallest volume Hetzner creates, in GB
+const minVolumeSize = 10
+
+// reservedLabels are set by the provider to find the resources it created
+var reservedLabels = []string{"type", "machineId"}
+
+// StopMode controls what happens to the server when a workspace is stopped
+type StopMode string
+
+const (
+	// StopModeDelete deletes the server, keeping only the volume
+	StopModeDelete StopMode = "delete"
+	// StopModePowerOff keeps the server and cuts its power
+	StopModePowerOff StopMode = "poweroff"
+	// StopModeShutdown keeps the server and gracefully shuts down the OS
+	StopModeShutdown StopMode = "shutdown"
+	// StopModeSnapshot snapshots the server before deleting it. The next
+	// start restores from the snapshot.
+	StopModeSnapshot StopMode = "snapshot"
+)
+
+// ContainerRuntime controls how the container runtime is set up on a new
+// server. If empty, it's chosen from the image.
+type ContainerRuntime string
+
+const (
+	// ContainerRuntimeSkip installs nothing as the image already has Docker
+	ContainerRuntimeSkip ContainerRuntime = "skip"
+	// ContainerRuntimeGetDocker installs Docker with the get.docker.com script
+	ContainerRuntimeGetDocker ContainerRuntime = "get-docker"
+	// ContainerRuntimeDistroPackage installs Docker from the OS's own packages
+	ContainerRuntimeDistroPackage ContainerRuntime = "distro-package"
+	// ContainerRuntimePodman installs Podman with its Docker compatible CLI
+	ContainerRuntimePodman ContainerRuntime = "podman"
+)
+
+// AddressType is a kind of server address that can be used to connect to it
+type AddressType string
+
+const (
+	AddressIPv4    AddressType = "ipv4"
+	AddressIPv6    AddressType = "ipv6"
+	AddressPrivate AddressType = "private"
 )
 
+// DefaultAddressPreference tries the public addresses first
+var DefaultAddressPreference = []AddressType{AddressIPv4, AddressIPv6, AddressPrivate}
+
+// FirewallRule allows inbound traffic through the workspace firewall
+type FirewallRule struct {
+	Protocol string
+	Port     string
+	Sources  []net.IPNet
+}
+
+// ExtraVolume is an additional volume for the workspace
+type ExtraVolume struct {
+	Name string
+	Size int
+	Path string
+}
+
 type Options struct {
 	MachineID     string
 	MachineFolder string
 
-	Region      string
-	DiskImage   string
-	DiskSize    string
-	MachineType string
-	Token       string
+	Region                    string
+	DiskImage                 string
+	DiskSize                  int
+	PersistentVolume          bool
+	ExtraVolumes              []ExtraVolume
+	VolumeFilesystem          string
+	VolumeMountPath           string
+	VolumeMountOptions        string
+	MachineType               string
+	Token                     string
+	Endpoint                  string
+	StopMode                  StopMode
+	Rollback                  bool
+	Network                   string
+	NetworkIP                 net.IP
+	AddressPreference         []AddressType
+	PublicIPv4                bool
+	PublicIPv6                bool
+	PrimaryIPs                bool
+	PlacementGroup            string
+	Labels                    map[string]string
+	CloudInitExtra            string
+	CloudInitAllowUnknownKeys bool
+	ContainerRuntime          ContainerRuntime
+	UserDataScripts           []string
+	UserDataIncludes          []string
+	JumpHostUser              string
+	JumpHostAddress           string
+	JumpHostKey               string
+	Firewall                  bool
+	FirewallSSH               []net.IPNet
+	FirewallRules             []FirewallRule
+	Firewalls                 []string
+	FirewallSelector          string
+	ProvisionTimeout          time.Duration
 }
 
 func FromEnv(skipMachine bool) (*Options, error) {
@@ -54,10 +162,14 @@ func FromEnv(skipMachine bool) (*Options, error) {
 	if err != nil {
 		return nil, err
 	}
-	retOptions.DiskSize, err = fromEnvOrError("DISK_SIZE")
+	diskSize, err := fromEnvOrError("DISK_SIZE")
 	if err != nil {
 		return nil, err
 	}
+	retOptions.DiskSize, err = strconv.Atoi(diskSize)
+	if err != nil || retOptions.DiskSize < minVolumeSize {
+		return nil, fmt.Errorf("invalid DISK_SIZE %q, must be a number of GB, at least %d", diskSize, minVolumeSize)
+	}
 	retOptions.DiskImage, err = fromEnvOrError("DISK_IMAGE")
 	if err != nil {
 		return nil, err
@@ -71,9 +183,478 @@ func FromEnv(skipMachine bool) (*Options, error) {
 		return nil, err
 	}
 
+	// Optional - defaults to the public Hetzner Cloud API
+	retOptions.Endpoint = os.Getenv("HCLOUD_ENDPOINT")
+
+	for _, fromEnv := range []func(*Options) error{
+		lifecycleFromEnv,
+		networkFromEnv,
+		firewallFromEnv,
+		cloudInitFromEnv,
+		volumeFromEnv,
+	} {
+		if err := fromEnv(retOptions); err != nil {
+			return nil, err
+		}
+	}
+
 	return retOptions, nil
 }
 
+// lifecycleFromEnv reads the options controlling how the server is created
+// and stopped
+func lifecycleFromEnv(o *Options) (err error) {
+	o.StopMode = StopMode(fromEnvOrDefault("STOP_MODE", string(StopModeDelete)))
+	switch o.StopMode {
+	case StopModeDelete, StopModePowerOff, StopModeShutdown, StopModeSnapshot:
+	default:
+		return fmt.Errorf("unknown STOP_MODE %q, must be one of: %s, %s, %s, %s",
+			o.StopMode, StopModeDelete, StopModePowerOff, StopModeShutdown, StopModeSnapshot)
+	}
+
+	o.Labels, err = parseLabels(os.Getenv("LABELS"))
+	if err != nil {
+		return fmt.Errorf("invalid LABELS: %w", err)
+	}
+
+	// Optional - spread the workspaces across hosts
+	o.PlacementGroup = os.Getenv("PLACEMENT_GROUP")
+
+	o.Rollback, err = strconv.ParseBool(fromEnvOrDefault("ROLLBACK_ON_FAILURE", "true"))
+	if err != nil {
+		return fmt.Errorf("invalid ROLLBACK_ON_FAILURE: %w", err)
+	}
+
+	o.ProvisionTimeout, err = time.ParseDuration(fromEnvOrDefault("PROVISION_TIMEOUT", "10m"))
+	if err != nil {
+		return fmt.Errorf("invalid PROVISION_TIMEOUT: %w", err)
+	}
+	if o.ProvisionTimeout <= 0 {
+		return fmt.Errorf("PROVISION_TIMEOUT must be positive, got %s", o.ProvisionTimeout)
+	}
+
+	return nil
+}
+
+// networkFromEnv reads the options controlling the server's addresses and how
+// it is connected to
+func networkFromEnv(o *Options) (err error) {
+	// Optional - join an existing private network
+	o.Network = os.Getenv("NETWORK")
+	if ip := os.Getenv("NETWORK_IP"); ip != "" {
+		if o.Network == "" {
+			return fmt.Errorf("NETWORK_IP requires NETWORK to be set")
+		}
+		o.NetworkIP = net.ParseIP(ip)
+		if o.NetworkIP == nil {
+			return fmt.Errorf("invalid NETWORK_IP: %q", ip)
+		}
+	}
+
+	o.AddressPreference, err = addressPreferenceFromEnv()
+	if err != nil {
+		return err
+	}
+
+	o.PublicIPv4, err = strconv.ParseBool(fromEnvOrDefault("PUBLIC_IPV4", "true"))
+	if err != nil {
+		return fmt.Errorf("invalid PUBLIC_IPV4: %w", err)
+	}
+	o.PublicIPv6, err = strconv.ParseBool(fromEnvOrDefault("PUBLIC_IPV6", "true"))
+	if err != nil {
+		return fmt.Errorf("invalid PUBLIC_IPV6: %w", err)
+	}
+	if !o.PublicIPv4 && !o.PublicIPv6 {
+		if o.Network == "" {
+			return fmt.Errorf("NETWORK must be set if PUBLIC_IPV4 and PUBLIC_IPV6 are disabled")
+		}
+		if o.NetworkIP != nil {
+			// The IP can only be set by attaching the network after the server is created
+			return fmt.Errorf("NETWORK_IP can't be set if PUBLIC_IPV4 and PUBLIC_IPV6 are disabled")
+		}
+	}
+
+	o.PrimaryIPs, err = strconv.ParseBool(fromEnvOrDefault("PRIMARY_IPS", "false"))
+	if err != nil {
+		return fmt.Errorf("invalid PRIMARY_IPS: %w", err)
+	}
+
+	// Optional - connect through a jump host, eg user@host:port
+	if jumpHost := os.Getenv("JUMP_HOST"); jumpHost != "" {
+		o.JumpHostUser, o.JumpHostAddress, err = parseJumpHost(jumpHost)
+		if err != nil {
+			return err
+		}
+		o.JumpHostKey = os.Getenv("JUMP_HOST_KEY")
+	}
+
+	return nil
+}
+
+// firewallFromEnv reads the options for the workspace's firewall and any
+// shared firewalls
+func firewallFromEnv(o *Options) (err error) {
+	// Optional - shared firewalls, by name and with a label selector
+	o.Firewalls = splitList(os.Getenv("FIREWALLS"))
+	o.FirewallSelector = strings.TrimSpace(os.Getenv("FIREWALL_SELECTOR"))
+
+	o.Firewall, err = strconv.ParseBool(fromEnvOrDefault("FIREWALL", "false"))
+	if err != nil {
+		return fmt.Errorf("invalid FIREWALL: %w", err)
+	}
+	if !o.Firewall {
+		return nil
+	}
+
+	o.FirewallSSH, err = parseCIDRs(fromEnvOrDefault("FIREWALL_SSH_SOURCES", "0.0.0.0/0,::/0"), ",")
+	if err != nil {
+		return fmt.Errorf("invalid FIREWALL_SSH_SOURCES: %w", err)
+	}
+
+	o.FirewallRules, err = parseFirewallRules(os.Getenv("FIREWALL_RULES"))
+
+	return err
+}
+
+// cloudInitFromEnv reads the options used to provision the server
+func cloudInitFromEnv(o *Options) (err error) {
+	// Optional - a file or inline YAML merged into the cloud-config. Files are
+	// read when the server is created, so other commands don't need them.
+	o.CloudInitExtra = os.Getenv("CLOUD_INIT_EXTRA")
+
+	o.CloudInitAllowUnknownKeys, err = strconv.ParseBool(fromEnvOrDefault("CLOUD_INIT_ALLOW_UNKNOWN_KEYS", "false"))
+	if err != nil {
+		return fmt.Errorf("invalid CLOUD_INIT_ALLOW_UNKNOWN_KEYS: %w", err)
+	}
+
+	o.ContainerRuntime = ContainerRuntime(os.Getenv("CONTAINER_RUNTIME"))
+	switch o.ContainerRuntime {
+	case "", ContainerRuntimeSkip, ContainerRuntimeGetDocker, ContainerRuntimeDistroPackage, ContainerRuntimePodman:
+	default:
+		return fmt.Errorf("unknown CONTAINER_RUNTIME %q, must be one of: %s, %s, %s, %s", o.ContainerRuntime,
+			ContainerRuntimeSkip, ContainerRuntimeGetDocker, ContainerRuntimeDistroPackage, ContainerRuntimePodman)
+	}
+
+	// Optional - comma separated paths to scripts run on first boot. They're
+	// read when the server is created, so other commands don't need them.
+	for _, path := range splitList(os.Getenv("USER_DATA_SCRIPTS")) {
+		path, err := expandHome(path)
+		if err != nil {
+			return fmt.Errorf("invalid USER_DATA_SCRIPTS: %w", err)
+		}
+		o.UserDataScripts = append(o.UserDataScripts, path)
+	}
+
+	// Optional - comma separated URLs cloud-init downloads and processes
+	o.UserDataIncludes = splitList(os.Getenv("USER_DATA_INCLUDES"))
+	for _, include := range o.UserDataIncludes {
+		u, err := url.Parse(include)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid USER_DATA_INCLUDES: %s is not an http or https URL", include)
+		}
+	}
+
+	return nil
+}
+
+// volumeFromEnv reads the options for the workspace's volume
+func volumeFromEnv(o *Options) (err error) {
+	o.PersistentVolume, err = strconv.ParseBool(fromEnvOrDefault("PERSISTENT_VOLUME", "true"))
+	if err != nil {
+		return fmt.Errorf("invalid PERSISTENT_VOLUME: %w", err)
+	}
+
+	o.VolumeFilesystem = fromEnvOrDefault("VOLUME_FILESYSTEM", "ext4")
+	if !slices.Contains([]string{"ext4", "xfs"}, o.VolumeFilesystem) {
+		return fmt.Errorf("unknown VOLUME_FILESYSTEM %q, must be one of: ext4, xfs", o.VolumeFilesystem)
+	}
+
+	// Optional - defaults to the user's home directory
+	o.VolumeMountPath = os.Getenv("VOLUME_MOUNT_PATH")
+	if o.VolumeMountPath != "" {
+		if !isMountPath(o.VolumeMountPath) {
+			return fmt.Errorf("invalid VOLUME_MOUNT_PATH %q, must be an absolute path without spaces", o.VolumeMountPath)
+		}
+		o.VolumeMountPath = path.Clean(o.VolumeMountPath)
+	}
+
+	o.VolumeMountOptions = fromEnvOrDefault("VOLUME_MOUNT_OPTIONS", "discard,nofail,defaults")
+	if strings.ContainsFunc(o.VolumeMountOptions, unicode.IsSpace) {
+		return fmt.Errorf("invalid VOLUME_MOUNT_OPTIONS %q, must be comma separated without spaces", o.VolumeMountOptions)
+	}
+
+	o.ExtraVolumes, err = parseExtraVolumes(os.Getenv("EXTRA_VOLUMES"))
+	if err != nil {
+		return fmt.Errorf("invalid EXTRA_VOLUMES: %w", err)
+	}
+
+	return nil
+}
+
+// parseExtraVolumes parses a comma separated list of name:size:path volumes
+func parseExtraVolumes(value string) ([]ExtraVolume, error) {
+	volumes := make([]ExtraVolume, 0)
+	for _, v := range splitList(value) {
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("volume %q must be in the format name:size:path", v)
+		}
+
+		volume := ExtraVolume{Name: parts[0], Path: parts[2]}
+		if !extraVolumeName.MatchString(volume.Name) {
+			return nil, fmt.Errorf(
+				"volume name %q must be up to 57 letters, numbers and dashes, starting and ending with a letter or number",
+				volume.Name,
+			)
+		}
+
+		var err error
+		if volume.Size, err = strconv.Atoi(parts[1]); err != nil || volume.Size < minVolumeSize {
+			return nil, fmt.Errorf("volume %s size %q must be a number of GB, at least %d", volume.Name, parts[1], minVolumeSize)
+		}
+
+		if !isMountPath(volume.Path) {
+			return nil, fmt.Errorf("volume %s path %q must be an absolute path without spaces", volume.Name, volume.Path)
+		}
+		volume.Path = path.Clean(volume.Path)
+
+		for _, other := range volumes {
+			if other.Name == volume.Name || other.Path == volume.Path {
+				return nil, fmt.Errorf("volume %s has the same name or path as %s", volume.Name, other.Name)
+			}
+		}
+
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// isMountPath checks the path can be used in /etc/fstab
+func isMountPath(p string) bool {
+	return path.IsAbs(p) && !strings.ContainsFunc(p, unicode.IsSpace)
+}
+
+// addressPreferenceFromEnv parses ADDRESS_PREFERENCE, a comma separated list
+// of address types
+func addressPreferenceFromEnv() ([]AddressType, error) {
+	value := os.Getenv("ADDRESS_PREFERENCE")
+	if value == "" {
+		return DefaultAddressPreference, nil
+	}
+
+	preference := make([]AddressType, 0)
+	for _, v := range splitList(value) {
+		addressType := AddressType(v)
+		switch addressType {
+		case AddressIPv4, AddressIPv6, AddressPrivate:
+		default:
+			return nil, fmt.Errorf("unknown ADDRESS_PREFERENCE %q, must be a list of: %s, %s, %s",
+				addressType, AddressIPv4, AddressIPv6, AddressPrivate)
+		}
+		if !slices.Contains(preference, addressType) {
+			preference = append(preference, addressType)
+		}
+	}
+	if len(preference) == 0 {
+		return nil, fmt.Errorf("ADDRESS_PREFERENCE must list at least one of: %s, %s, %s", AddressIPv4, AddressIPv6, AddressPrivate)
+	}
+
+	return preference, nil
+}
+
+// parseLabels parses a comma separated list of key=value labels, checking
+// they're valid Hetzner labels
+func parseLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, v := range splitList(value) {
+		key, val, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be in the format key=value", v)
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+
+		if slices.Contains(reservedLabels, key) {
+			return nil, fmt.Errorf("label %q is reserved", key)
+		}
+		if _, err := hcloud.ValidateResourceLabels(map[string]any{key: val}); err != nil {
+			return nil, err
+		}
+
+		labels[key] = val
+	}
+	return labels, nil
+}
+
+// parseCIDRs parses a list of CIDRs. A plain IP is treated as a single host.
+func parseCIDRs(value, sep string) ([]net.IPNet, error) {
+	cidrs := make([]net.IPNet, 0)
+	for _, v := range strings.Split(value, sep) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", v)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			cidrs = append(cidrs, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, *cidr)
+	}
+
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no CIDRs given")
+	}
+
+	return cidrs, nil
+}
+
+// parseFirewallRules parses FIREWALL_RULES, a comma separated list of
+// protocol:port:sources, eg "tcp:443:0.0.0.0/0|::/0,icmp". The sources are
+// separated by "|" and default to everywhere. ICMP, ESP and GRE have no port.
+func parseFirewallRules(value string) ([]FirewallRule, error) {
+	rules := make([]FirewallRule, 0)
+
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		parts := strings.SplitN(v, ":", 3)
+		rule := FirewallRule{Protocol: parts[0]}
+		if len(parts) > 1 {
+			rule.Port = parts[1]
+		}
+
+		sources := "0.0.0.0/0|::/0"
+		if len(parts) > 2 && parts[2] != "" {
+			sources = parts[2]
+		}
+
+		var err error
+		if rule.Sources, err = parseCIDRs(sources, "|"); err != nil {
+			return nil, fmt.Errorf("invalid FIREWALL_RULES %q: %w", v, err)
+		}
+
+		switch rule.Protocol {
+		case "tcp", "udp":
+			if rule.Port == "" {
+				return nil, fmt.Errorf("invalid FIREWALL_RULES %q: %s rules need a port or range", v, rule.Protocol)
+			}
+		case "icmp", "esp", "gre":
+			if rule.Port != "" {
+				return nil, fmt.Errorf("invalid FIREWALL_RULES %q: %s rules can't have a port", v, rule.Protocol)
+			}
+		default:
+			return nil, fmt.Errorf("invalid FIREWALL_RULES %q: unknown protocol %q", v, rule.Protocol)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// parseJumpHost splits [user@]host[:port], defaulting to root on port 22
+func parseJumpHost(jumpHost string) (user, address string, err error) {
+	user, host, found := strings.Cut(jumpHost, "@")
+	if !found {
+		user, host = "root", jumpHost
+	}
+
+	port := "22"
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+
+	if user == "" || host == "" {
+		return "", "", fmt.Errorf("invalid JUMP_HOST %q, must be in the format [user@]host[:port]", jumpHost)
+	}
+
+	return user, net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+// FileOrInline returns the contents of the file if the value is a path,
+// otherwise the value itself. Values on one line without a colon or spaces,
+// or that look like a path to a YAML file, are paths.
+func FileOrInline(value string) (string, error) {
+	if !isFilePath(value) {
+		return value, nil
+	}
+
+	path, err := expandHome(value)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path) //nolint:gosec // the path is chosen by the user
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func isFilePath(value string) bool {
+	if value == "" || strings.Contains(value, "\n") || strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		return false
+	}
+
+	for _, prefix := range []string{"/", "./", "../", "~"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+
+	ext := filepath.Ext(value)
+	return !strings.ContainsAny(value, ": \t") || ext == ".yaml" || ext == ".yml"
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, path[1:]), nil
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func fromEnvOrDefault(name, defaultValue string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return defaultValue
+}
+
 func fromEnvOrError(name string, fallback ...string) (string, error) {
 	envvars := append([]string{name}, fallback...)
 
@@ -0,0 +1,543 @@
+/*
+ * Copyright 2023 Simon Emms <simon@simonemms.com>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCIDR(t *testing.T, value string) net.IPNet {
+	t.Helper()
+
+	_, cidr, err := net.ParseCIDR(value)
+	assert.NoError(t, err)
+
+	return *cidr
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Value    string
+		Sep      string
+		Expected []net.IPNet
+		Error    string
+	}{
+		{
+			Name:     "IPv4 and IPv6",
+			Value:    "10.0.0.0/8,2001:db8::/32",
+			Sep:      ",",
+			Expected: []net.IPNet{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "2001:db8::/32")},
+		},
+		{
+			Name:     "plain IPs are single hosts",
+			Value:    "203.0.113.1|2001:db8::1",
+			Sep:      "|",
+			Expected: []net.IPNet{mustCIDR(t, "203.0.113.1/32"), mustCIDR(t, "2001:db8::1/128")},
+		},
+		{
+			Name:     "host bits are masked",
+			Value:    "192.168.1.10/24",
+			Sep:      ",",
+			Expected: []net.IPNet{mustCIDR(t, "192.168.1.0/24")},
+		},
+		{
+			Name:     "trailing comma and spaces",
+			Value:    " 0.0.0.0/0, ::/0 ,",
+			Sep:      ",",
+			Expected: []net.IPNet{mustCIDR(t, "0.0.0.0/0"), mustCIDR(t, "::/0")},
+		},
+		{
+			Name:  "empty",
+			Value: "",
+			Sep:   ",",
+			Error: "no CIDRs given",
+		},
+		{
+			Name:  "only separators",
+			Value: ",,",
+			Sep:   ",",
+			Error: "no CIDRs given",
+		},
+		{
+			Name:  "invalid IP",
+			Value: "10.0.0.256",
+			Sep:   ",",
+			Error: `invalid IP "10.0.0.256"`,
+		},
+		{
+			Name:  "invalid prefix",
+			Value: "2001:db8::/129",
+			Sep:   ",",
+			Error: "invalid CIDR address",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			cidrs, err := parseCIDRs(test.Value, test.Sep)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, cidrs)
+		})
+	}
+}
+
+func TestParseFirewallRules(t *testing.T) {
+	everywhere := []net.IPNet{mustCIDR(t, "0.0.0.0/0"), mustCIDR(t, "::/0")}
+
+	tests := []struct {
+		Name     string
+		Value    string
+		Expected []FirewallRule
+		Error    string
+	}{
+		{
+			Name:     "empty",
+			Value:    "",
+			Expected: []FirewallRule{},
+		},
+		{
+			Name:  "sources default to everywhere",
+			Value: "tcp:443,icmp",
+			Expected: []FirewallRule{
+				{Protocol: "tcp", Port: "443", Sources: everywhere},
+				{Protocol: "icmp", Sources: everywhere},
+			},
+		},
+		{
+			Name:  "port range and sources",
+			Value: "udp:60000-61000:203.0.113.0/24|2001:db8::/32",
+			Expected: []FirewallRule{
+				{Protocol: "udp", Port: "60000-61000", Sources: []net.IPNet{mustCIDR(t, "203.0.113.0/24"), mustCIDR(t, "2001:db8::/32")}},
+			},
+		},
+		{
+			Name:  "trailing comma",
+			Value: "tcp:80, gre,",
+			Expected: []FirewallRule{
+				{Protocol: "tcp", Port: "80", Sources: everywhere},
+				{Protocol: "gre", Sources: everywhere},
+			},
+		},
+		{
+			Name:  "empty sources",
+			Value: "esp::",
+			Expected: []FirewallRule{
+				{Protocol: "esp", Sources: everywhere},
+			},
+		},
+		{
+			Name:  "missing port",
+			Value: "tcp",
+			Error: `invalid FIREWALL_RULES "tcp": tcp rules need a port or range`,
+		},
+		{
+			Name:  "port on icmp",
+			Value: "icmp:8",
+			Error: `invalid FIREWALL_RULES "icmp:8": icmp rules can't have a port`,
+		},
+		{
+			Name:  "unknown protocol",
+			Value: "sctp:9899",
+			Error: `invalid FIREWALL_RULES "sctp:9899": unknown protocol "sctp"`,
+		},
+		{
+			Name:  "invalid source",
+			Value: "tcp:22:10.0.0.0/33",
+			Error: `invalid FIREWALL_RULES "tcp:22:10.0.0.0/33"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rules, err := parseFirewallRules(test.Value)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, rules)
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Value    string
+		Expected map[string]string
+		Error    string
+	}{
+		{
+			Name:     "empty",
+			Value:    "",
+			Expected: map[string]string{},
+		},
+		{
+			Name:     "labels",
+			Value:    "team=payments, project=checkout,",
+			Expected: map[string]string{"team": "payments", "project": "checkout"},
+		},
+		{
+			Name:     "empty value",
+			Value:    "example.com/owner=",
+			Expected: map[string]string{"example.com/owner": ""},
+		},
+		{
+			Name:  "missing value",
+			Value: "team",
+			Error: `label "team" must be in the format key=value`,
+		},
+		{
+			Name:  "reserved",
+			Value: "machineId=other",
+			Error: `label "machineId" is reserved`,
+		},
+		{
+			Name:  "invalid value",
+			Value: "team=cost centre",
+			Error: "cost centre",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			labels, err := parseLabels(test.Value)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, labels)
+		})
+	}
+}
+
+func TestParseExtraVolumes(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Value    string
+		Expected []ExtraVolume
+		Error    string
+	}{
+		{
+			Name:     "empty",
+			Value:    "",
+			Expected: []ExtraVolume{},
+		},
+		{
+			Name:  "volumes",
+			Value: "docker:50:/var/lib/docker/,cache:10:/srv/cache,",
+			Expected: []ExtraVolume{
+				{Name: "docker", Size: 50, Path: "/var/lib/docker"},
+				{Name: "cache", Size: 10, Path: "/srv/cache"},
+			},
+		},
+		{
+			Name:  "missing path",
+			Value: "docker:50",
+			Error: `volume "docker:50" must be in the format name:size:path`,
+		},
+		{
+			Name:  "too small",
+			Value: "docker:5:/var/lib/docker",
+			Error: `volume docker size "5" must be a number of GB, at least 10`,
+		},
+		{
+			Name:  "size isn't a number",
+			Value: "docker:50GB:/var/lib/docker",
+			Error: `volume docker size "50GB" must be a number of GB, at least 10`,
+		},
+		{
+			Name:  "invalid name",
+			Value: "docker_data:50:/var/lib/docker",
+			Error: `volume name "docker_data" must be up to 57 letters`,
+		},
+		{
+			Name:  "relative path",
+			Value: "docker:50:var/lib/docker",
+			Error: `volume docker path "var/lib/docker" must be an absolute path without spaces`,
+		},
+		{
+			Name:  "same path",
+			Value: "docker:50:/var/lib/docker,other:10:/var/lib/docker/",
+			Error: "volume other has the same name or path as docker",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			volumes, err := parseExtraVolumes(test.Value)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, volumes)
+		})
+	}
+}
+
+func TestParseJumpHost(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Value   string
+		User    string
+		Address string
+		Error   string
+	}{
+		{
+			Name:    "host",
+			Value:   "bastion.example.com",
+			User:    "root",
+			Address: "bastion.example.com:22",
+		},
+		{
+			Name:    "user and port",
+			Value:   "admin@203.0.113.1:2222",
+			User:    "admin",
+			Address: "203.0.113.1:2222",
+		},
+		{
+			Name:    "IPv6 with port",
+			Value:   "[2001:db8::1]:2222",
+			User:    "root",
+			Address: "[2001:db8::1]:2222",
+		},
+		{
+			Name:    "IPv6 without port",
+			Value:   "[2001:db8::1]",
+			User:    "root",
+			Address: "[2001:db8::1]:22",
+		},
+		{
+			Name:  "missing user",
+			Value: "@bastion.example.com",
+			Error: `invalid JUMP_HOST "@bastion.example.com"`,
+		},
+		{
+			Name:  "missing host",
+			Value: "admin@",
+			Error: `invalid JUMP_HOST "admin@"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			user, address, err := parseJumpHost(test.Value)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.User, user)
+			assert.Equal(t, test.Address, address)
+		})
+	}
+}
+
+func TestAddressPreferenceFromEnv(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Value    string
+		Expected []AddressType
+		Error    string
+	}{
+		{
+			Name:     "default",
+			Value:    "",
+			Expected: DefaultAddressPreference,
+		},
+		{
+			Name:     "order",
+			Value:    "private, ipv6",
+			Expected: []AddressType{AddressPrivate, AddressIPv6},
+		},
+		{
+			Name:     "duplicates",
+			Value:    "ipv6,ipv4,ipv6",
+			Expected: []AddressType{AddressIPv6, AddressIPv4},
+		},
+		{
+			Name:  "unknown",
+			Value: "ipv4,public",
+			Error: `unknown ADDRESS_PREFERENCE "public"`,
+		},
+		{
+			Name:     "trailing comma",
+			Value:    "ipv4,",
+			Expected: []AddressType{AddressIPv4},
+		},
+		{
+			Name:  "only separators",
+			Value: ",",
+			Error: "ADDRESS_PREFERENCE must list at least one of: ipv4, ipv6, private",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Setenv("ADDRESS_PREFERENCE", test.Value)
+
+			preference, err := addressPreferenceFromEnv()
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, preference)
+		})
+	}
+}
+
+func TestFirewallFromEnv(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Firewalls string
+		Selector  string
+		Names     []string
+	}{
+		{
+			Name:  "none",
+			Names: []string{},
+		},
+		{
+			Name:      "names",
+			Firewalls: "dev-vm-baseline, office,",
+			Names:     []string{"dev-vm-baseline", "office"},
+		},
+		{
+			Name:     "selector with a list",
+			Selector: "env in (dev,staging)",
+			Names:    []string{},
+		},
+		{
+			Name:     "selector without an equals",
+			Selector: "!env",
+			Names:    []string{},
+		},
+		{
+			Name:      "both",
+			Firewalls: "office",
+			Selector:  "role=baseline",
+			Names:     []string{"office"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Setenv("FIREWALL", "")
+			t.Setenv("FIREWALLS", test.Firewalls)
+			t.Setenv("FIREWALL_SELECTOR", test.Selector)
+
+			o := &Options{}
+			assert.NoError(t, firewallFromEnv(o))
+			assert.Equal(t, test.Names, o.Firewalls)
+			assert.Equal(t, test.Selector, o.FirewallSelector)
+		})
+	}
+}
+
+func TestFileOrInline(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	assert.NoError(t, os.WriteFile(filepath.Join(home, "cloud-init.yaml"), []byte("packages:\n  - htop\n"), 0o600))
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "extra"), []byte("runcmd: []\n"), 0o600))
+
+	tests := []struct {
+		Name     string
+		Value    string
+		Expected string
+		Error    string
+	}{
+		{
+			Name:     "empty",
+			Value:    "",
+			Expected: "",
+		},
+		{
+			Name:     "inline mapping",
+			Value:    "packages: [htop]",
+			Expected: "packages: [htop]",
+		},
+		{
+			Name:     "inline flow mapping",
+			Value:    "{packages: [htop]}",
+			Expected: "{packages: [htop]}",
+		},
+		{
+			Name:     "inline list",
+			Value:    "- htop",
+			Expected: "- htop",
+		},
+		{
+			Name:     "multiple lines",
+			Value:    "packages:\n  - htop\n",
+			Expected: "packages:\n  - htop\n",
+		},
+		{
+			Name:     "home directory",
+			Value:    "~/cloud-init.yaml",
+			Expected: "packages:\n  - htop\n",
+		},
+		{
+			Name:     "absolute path without an extension",
+			Value:    filepath.Join(dir, "extra"),
+			Expected: "runcmd: []\n",
+		},
+		{
+			Name:  "missing file",
+			Value: "~/missing.yaml",
+			Error: "no such file or directory",
+		},
+		{
+			Name:  "missing relative file",
+			Value: "cloud-init.yml",
+			Error: "open cloud-init.yml",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			value, err := FileOrInline(test.Value)
+			if test.Error != "" {
+				assert.ErrorContains(t, err, test.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, value)
+		})
+	}
+}